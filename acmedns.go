@@ -0,0 +1,292 @@
+package temptxt
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// acmeDNSMaxValues is the number of values kept for a record updated
+// through the acme-dns API. This allows a wildcard and the apex to be
+// validated at the same time.
+const acmeDNSMaxValues = 2
+
+// defaultAcmeDNSMaxAccounts is the number of accounts that can be registered
+// so that open registration can't be used to create records without limit.
+const defaultAcmeDNSMaxAccounts = 1000
+
+const passwordChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_"
+
+// acmeDNS holds the configuration for the acme-dns compatible API.
+type acmeDNS struct {
+	zone string
+	// allowed is the list of users that may register.
+	// Registration is open if it is empty.
+	allowed  []*regexp.Regexp
+	accounts map[string]*acmeDNSAccount
+	// maxAccounts is the number of accounts that can be registered.
+	maxAccounts int
+}
+
+type acmeDNSAccount struct {
+	Subdomain string `json:"subdomain"`
+	// KeyHash is the SHA256 hash of the password.
+	KeyHash []byte `json:"key_hash"`
+}
+
+type acmeDNSRegisterBody struct {
+	AllowFrom []string `json:"allowfrom"`
+}
+
+type acmeDNSRegisterResponse struct {
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	FullDomain string   `json:"fulldomain"`
+	Subdomain  string   `json:"subdomain"`
+	AllowFrom  []string `json:"allowfrom"`
+}
+
+type acmeDNSUpdateBody struct {
+	Subdomain string `json:"subdomain"`
+	Txt       string `json:"txt"`
+}
+
+func (a *acmeDNS) canRegister(user string) bool {
+	if len(a.allowed) == 0 {
+		return true
+	}
+	for _, r := range a.allowed {
+		if r.MatchString(user) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *acmeDNS) fqdn(subdomain string) string {
+	return strings.ToLower(subdomain) + "." + a.zone
+}
+
+// addAcmeDNSAccount creates the record for an account.
+// tt.mtx must be held by the caller.
+func (tt *TempTxt) addAcmeDNSAccount(username string, account *acmeDNSAccount) error {
+	fqdn := tt.acmeDNS.fqdn(account.Subdomain)
+	if _, ok := tt.records[fqdn]; ok {
+		return fmt.Errorf("record %q already exists", fqdn)
+	}
+	if _, ok := tt.aliases[fqdn]; ok {
+		return fmt.Errorf("alias %q already exists", fqdn)
+	}
+
+	r := &Record{
+		fqdn:    fqdn,
+		store:   tt.store,
+		allowed: []*regexp.Regexp{regexp.MustCompile("^" + regexp.QuoteMeta(username) + "$")},
+	}
+	tt.records[fqdn] = r
+	tt.aliases[fqdn] = r
+	tt.acmeDNS.accounts[username] = account
+	return nil
+}
+
+func (tt *TempTxt) acmeDNSRegisterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := tt.requestUser(r)
+	if !tt.acmeDNS.canRegister(user) {
+		log.Errorf("Unauthorized acme-dns registration from user %q", user)
+		acmeDNSError(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	body := acmeDNSRegisterBody{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			acmeDNSError(w, "malformed_json_payload", http.StatusBadRequest)
+			return
+		}
+	}
+	if len(body.AllowFrom) > 0 {
+		acmeDNSError(w, "allowfrom_not_supported", http.StatusBadRequest)
+		return
+	}
+
+	username, err := randomUUID()
+	if err != nil {
+		log.Errorf("Error generating username: %v", err)
+		acmeDNSError(w, "internal_error", http.StatusInternalServerError)
+		return
+	}
+	subdomain, err := randomUUID()
+	if err != nil {
+		log.Errorf("Error generating subdomain: %v", err)
+		acmeDNSError(w, "internal_error", http.StatusInternalServerError)
+		return
+	}
+	password, err := randomPassword(40)
+	if err != nil {
+		log.Errorf("Error generating password: %v", err)
+		acmeDNSError(w, "internal_error", http.StatusInternalServerError)
+		return
+	}
+	hash := sha256.Sum256([]byte(password))
+
+	tt.mtx.Lock()
+	if len(tt.acmeDNS.accounts) >= tt.acmeDNS.maxAccounts {
+		tt.mtx.Unlock()
+		log.Errorf("Refused acme-dns registration from user %q, %d accounts are already registered", user, tt.acmeDNS.maxAccounts)
+		acmeDNSError(w, "too_many_accounts", http.StatusForbidden)
+		return
+	}
+	err = tt.addAcmeDNSAccount(username, &acmeDNSAccount{Subdomain: subdomain, KeyHash: hash[:]})
+	tt.mtx.Unlock()
+	if err != nil {
+		log.Errorf("Error registering acme-dns account: %v", err)
+		acmeDNSError(w, "internal_error", http.StatusInternalServerError)
+		return
+	}
+	tt.saveAcmeDNSAccounts()
+
+	log.Infof("Registered acme-dns account %q for subdomain %q from user %q", username, subdomain, user)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(acmeDNSRegisterResponse{
+		Username:   username,
+		Password:   password,
+		FullDomain: strings.TrimSuffix(tt.acmeDNS.fqdn(subdomain), "."),
+		Subdomain:  subdomain,
+		AllowFrom:  []string{},
+	})
+}
+
+// acmeDNSUpdateHandler handles updates from acme-dns clients.
+// The details of the update are added to entry for the audit log.
+func (tt *TempTxt) acmeDNSUpdateHandler(w http.ResponseWriter, r *http.Request, entry *auditEntry) {
+	username := r.Header.Get("X-Api-User")
+	key := r.Header.Get("X-Api-Key")
+	entry.User = username
+	entry.Action = ActionAdd
+
+	tt.mtx.RLock()
+	account, ok := tt.acmeDNS.accounts[username]
+	tt.mtx.RUnlock()
+
+	hash := sha256.Sum256([]byte(key))
+	if !ok || subtle.ConstantTimeCompare(hash[:], account.KeyHash) != 1 {
+		log.Errorf("Invalid acme-dns credentials for user %q", username)
+		acmeDNSError(w, "forbidden", http.StatusUnauthorized)
+		return
+	}
+
+	if !tt.checkRate(w, username) {
+		return
+	}
+
+	ub := acmeDNSUpdateBody{}
+	if err := json.NewDecoder(r.Body).Decode(&ub); err != nil {
+		acmeDNSError(w, "malformed_json_payload", http.StatusBadRequest)
+		return
+	}
+	entry.Value = ub.Txt
+
+	if !strings.EqualFold(ub.Subdomain, account.Subdomain) {
+		log.Errorf("Unauthorized acme-dns update for subdomain %q from user %q", ub.Subdomain, username)
+		acmeDNSError(w, "forbidden", http.StatusUnauthorized)
+		return
+	}
+
+	if ub.Txt == "" || len(ub.Txt) > 255 {
+		acmeDNSError(w, "bad_txt", http.StatusBadRequest)
+		return
+	}
+
+	fqdn := tt.acmeDNS.fqdn(ub.Subdomain)
+	entry.FQDN = fqdn
+	record, ok := tt.getAlias(fqdn)
+	if ok {
+		entry.Record = record.fqdn
+	}
+	if !ok || !record.IsAuthorized(username) {
+		acmeDNSError(w, "bad_subdomain", http.StatusBadRequest)
+		return
+	}
+
+	unlock, err := tt.lockBytes(len(ub.Txt))
+	if err != nil {
+		log.Errorf("Error updating %q: %v", fqdn, err)
+		var le *limitError
+		if errors.As(err, &le) {
+			if le.retryAfter > 0 {
+				w.Header().Set("Retry-After", retryAfterSeconds(le.retryAfter))
+			}
+			acmeDNSError(w, "too_many_bytes", http.StatusTooManyRequests)
+		} else {
+			acmeDNSError(w, "internal_error", http.StatusInternalServerError)
+		}
+		return
+	}
+	_, err = record.update(func(s RecordState) RecordState {
+		s.Updated = time.Now()
+		s.Values = append(s.Values, Value{Txt: ub.Txt, Created: s.Updated})
+		if len(s.Values) > acmeDNSMaxValues {
+			s.Values = s.Values[len(s.Values)-acmeDNSMaxValues:]
+		}
+		return s
+	})
+	unlock()
+	if err != nil {
+		log.Errorf("Error updating %q: %v", fqdn, err)
+		acmeDNSError(w, "internal_error", http.StatusInternalServerError)
+		return
+	}
+
+	tt.setModified()
+	tt.replicate(record)
+	tt.notify(webhookEvent{Action: ActionAdd, FQDN: fqdn, Record: record.fqdn, User: username, Value: ub.Txt})
+
+	log.Infof("Received acme-dns update for %q from user %q", fqdn, username)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"txt": ub.Txt})
+}
+
+func acmeDNSError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// randomUUID returns a random (version 4) UUID.
+func randomUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
+
+func randomPassword(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = passwordChars[int(b[i])%len(passwordChars)]
+	}
+	return string(b), nil
+}
@@ -0,0 +1,195 @@
+package temptxt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func newAcmeDNSTempTxt(t *testing.T) *TempTxt {
+	t.Helper()
+	tt := newTestTempTxt(t)
+	tt.Next = testHandler()
+	tt.maxAge = defaultMaxAge
+	tt.acmeDNS = &acmeDNS{
+		zone:        "acme-dns.example.com.",
+		allowed:     []*regexp.Regexp{regexp.MustCompile("^admin$")},
+		accounts:    make(map[string]*acmeDNSAccount),
+		maxAccounts: defaultAcmeDNSMaxAccounts,
+	}
+	return tt
+}
+
+func acmeDNSRegister(t *testing.T, url string, user string) (*http.Response, acmeDNSRegisterResponse) {
+	t.Helper()
+	req, err := http.NewRequest("POST", url+"/register", nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("X-Forwarded-User", user)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	rr := acmeDNSRegisterResponse{}
+	if resp.StatusCode == http.StatusCreated {
+		if err := json.NewDecoder(resp.Body).Decode(&rr); err != nil {
+			t.Fatalf("Error decoding response: %v", err)
+		}
+	}
+	return resp, rr
+}
+
+func acmeDNSUpdate(t *testing.T, url string, user string, key string, subdomain string, txt string) *http.Response {
+	t.Helper()
+	body, _ := json.Marshal(acmeDNSUpdateBody{Subdomain: subdomain, Txt: txt})
+	req, err := http.NewRequest("POST", url+"/update", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("X-Api-User", user)
+	req.Header.Set("X-Api-Key", key)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestAcmeDNSRegisterForbidden(t *testing.T) {
+	tt := newAcmeDNSTempTxt(t)
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	resp, _ := acmeDNSRegister(t, s.URL, "other")
+	assertStatus(http.StatusForbidden, resp, t)
+}
+
+func TestAcmeDNSRegisterMaxAccounts(t *testing.T) {
+	tt := newAcmeDNSTempTxt(t)
+	tt.acmeDNS.maxAccounts = 2
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, _ := acmeDNSRegister(t, s.URL, "admin")
+		assertStatus(http.StatusCreated, resp, t)
+	}
+	resp, _ := acmeDNSRegister(t, s.URL, "admin")
+	assertStatus(http.StatusForbidden, resp, t)
+	if n := len(tt.acmeDNS.accounts); n != 2 {
+		t.Errorf("Expected %d accounts, got %d", 2, n)
+	}
+}
+
+func TestAcmeDNSRegisterAndUpdate(t *testing.T) {
+	tt := newAcmeDNSTempTxt(t)
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	resp, account := acmeDNSRegister(t, s.URL, "admin")
+	assertStatus(http.StatusCreated, resp, t)
+
+	if want := account.Subdomain + ".acme-dns.example.com"; account.FullDomain != want {
+		t.Errorf("Expected fulldomain %q, got %q", want, account.FullDomain)
+	}
+
+	// Only the last two values should be kept
+	for _, txt := range []string{"value1", "value2", "value3"} {
+		resp := acmeDNSUpdate(t, s.URL, account.Username, account.Password, account.Subdomain, txt)
+		assertStatus(http.StatusOK, resp, t)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(account.FullDomain+".", dns.TypeTXT)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	code, err := tt.ServeDNS(context.Background(), rec, req)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if code != dns.RcodeSuccess {
+		t.Fatalf("Expected rcode %s, but got %s", dns.RcodeToString[dns.RcodeSuccess], dns.RcodeToString[code])
+	}
+	if len(rec.Msg.Answer) != 2 {
+		t.Fatalf("Expected 2 answers, got %d", len(rec.Msg.Answer))
+	}
+	for i, want := range []string{"value2", "value3"} {
+		if have := rec.Msg.Answer[i].(*dns.TXT).Txt[0]; have != want {
+			t.Errorf("[%d] Expected answer %q, got %q", i, want, have)
+		}
+	}
+}
+
+func TestAcmeDNSUpdateErrors(t *testing.T) {
+	tt := newAcmeDNSTempTxt(t)
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	resp, account := acmeDNSRegister(t, s.URL, "admin")
+	assertStatus(http.StatusCreated, resp, t)
+	resp, other := acmeDNSRegister(t, s.URL, "admin")
+	assertStatus(http.StatusCreated, resp, t)
+
+	tests := []struct {
+		user      string
+		key       string
+		subdomain string
+		txt       string
+		want      int
+	}{
+		{user: account.Username, key: "invalid", subdomain: account.Subdomain, txt: "a", want: http.StatusUnauthorized},
+		{user: "invalid", key: account.Password, subdomain: account.Subdomain, txt: "a", want: http.StatusUnauthorized},
+		{user: account.Username, key: account.Password, subdomain: other.Subdomain, txt: "a", want: http.StatusUnauthorized},
+		{user: account.Username, key: account.Password, subdomain: account.Subdomain, txt: "", want: http.StatusBadRequest},
+	}
+
+	for i, tc := range tests {
+		resp := acmeDNSUpdate(t, s.URL, tc.user, tc.key, tc.subdomain, tc.txt)
+		if resp.StatusCode != tc.want {
+			t.Errorf("[%d] Expected status code %d, got %d", i, tc.want, resp.StatusCode)
+		}
+	}
+}
+
+func TestAcmeDNSPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	store, err := newFileStore(path, defaultMaxAge)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tt := newAcmeDNSTempTxt(t)
+	tt.store = store
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	resp, account := acmeDNSRegister(t, s.URL, "admin")
+	assertStatus(http.StatusCreated, resp, t)
+
+	store2, err := newFileStore(path, defaultMaxAge)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tt2 := newAcmeDNSTempTxt(t)
+	tt2.store = store2
+	if err := tt2.loadAcmeDNSAccounts(); err != nil {
+		t.Fatalf("Unexpected error loading: %v", err)
+	}
+	s2 := httptest.NewServer(tt2.handler())
+	defer s2.Close()
+
+	resp = acmeDNSUpdate(t, s2.URL, account.Username, account.Password, account.Subdomain, "value")
+	assertStatus(http.StatusOK, resp, t)
+}
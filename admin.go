@@ -0,0 +1,105 @@
+package temptxt
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// isAdmin returns true if user can use the admin API.
+func (tt *TempTxt) isAdmin(user string) bool {
+	for _, re := range tt.admins {
+		if re.MatchString(user) {
+			return true
+		}
+	}
+	return false
+}
+
+// adminRecordsHandler lists (GET) and creates (POST) record definitions.
+func (tt *TempTxt) adminRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := tt.getAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(tt.recordDefs()); err != nil {
+			log.Errorf("Error writing records response: %v", err)
+		}
+		return
+	}
+
+	def := recordDef{}
+	if err := json.NewDecoder(r.Body).Decode(&def); err != nil {
+		http.Error(w, "Error decoding JSON", http.StatusBadRequest)
+		return
+	}
+
+	tt.mtx.Lock()
+	if tt.hasRecordLocked(def) {
+		tt.mtx.Unlock()
+		http.Error(w, "record already exists", http.StatusConflict)
+		return
+	}
+	if err := tt.addRecordLocked(def); err != nil {
+		tt.mtx.Unlock()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tt.mtx.Unlock()
+
+	log.Infof("Admin %q added record %q", user, def.FQDN)
+	tt.audit(auditEntry{Source: auditSourceAdmin, User: user, RemoteAddr: r.RemoteAddr, FQDN: def.FQDN, Action: "create", Status: http.StatusCreated})
+	w.WriteHeader(http.StatusCreated)
+}
+
+// adminRecordHandler removes (DELETE) a record definition.
+func (tt *TempTxt) adminRecordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := tt.getAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/admin/records/")
+	if name == "" {
+		http.Error(w, "fqdn cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	tt.mtx.Lock()
+	removed, ok := tt.removeRecordLocked(name)
+	tt.mtx.Unlock()
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	tt.clearRecords(removed)
+
+	log.Infof("Admin %q removed record %q", user, name)
+	tt.audit(auditEntry{Source: auditSourceAdmin, User: user, RemoteAddr: r.RemoteAddr, FQDN: name, Action: "delete", Status: http.StatusNoContent})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getAdmin returns the user of the request if they can use the admin API.
+func (tt *TempTxt) getAdmin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user, ok := tt.getUser(w, r)
+	if !ok {
+		return "", false
+	}
+	if !tt.isAdmin(user) {
+		log.Errorf("Unauthorized admin request from user %q", user)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return "", false
+	}
+	return user, true
+}
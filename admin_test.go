@@ -0,0 +1,157 @@
+package temptxt
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func newAdminTempTxt(t *testing.T) *TempTxt {
+	t.Helper()
+	tt, err := parseConfig(caddy.NewTestController("dns", `temptxt _acme-challenge. {
+	admin provisioner
+	txt static.example.com user1
+}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tt.Next = testHandler()
+	return tt
+}
+
+func TestAdminRecords(t *testing.T) {
+	tt := newAdminTempTxt(t)
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	resp := sendRequest(t, "POST", s.URL+"/admin/records", `{"fqdn": "web01.example.com", "allowed": ["user-web01"]}`, "provisioner")
+	resp.Body.Close()
+	assertStatus(http.StatusCreated, resp, t)
+
+	resp = sendRequest(t, "POST", s.URL+"/admin/records", `{"fqdn": "web02.example.com", "alias": "web02.example.org", "allowed": ["user-web02"]}`, "provisioner")
+	resp.Body.Close()
+	assertStatus(http.StatusCreated, resp, t)
+
+	resp = sendRequest(t, "GET", s.URL+"/admin/records", "", "provisioner")
+	assertStatus(http.StatusOK, resp, t)
+	var defs []recordDef
+	if err := json.NewDecoder(resp.Body).Decode(&defs); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	resp.Body.Close()
+	want := []recordDef{
+		{FQDN: "_acme-challenge.static.example.com.", Alias: "static.example.com.", Allowed: []string{"user1"}},
+		{FQDN: "_acme-challenge.web01.example.com.", Alias: "web01.example.com.", Allowed: []string{"user-web01"}},
+		{FQDN: "_acme-challenge.web02.example.com.", Alias: "web02.example.org.", Allowed: []string{"user-web02"}},
+	}
+	if !reflect.DeepEqual(defs, want) {
+		t.Errorf("Expected %v, got %v", want, defs)
+	}
+
+	// The new record can be updated
+	resp = sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "web01.example.com", "content": "a"}`, "user-web01")
+	resp.Body.Close()
+	assertStatus(http.StatusNoContent, resp, t)
+
+	resp = sendRequest(t, "DELETE", s.URL+"/admin/records/web01.example.com", "", "provisioner")
+	resp.Body.Close()
+	assertStatus(http.StatusNoContent, resp, t)
+
+	resp = sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "web01.example.com", "content": "a"}`, "user-web01")
+	resp.Body.Close()
+	assertStatus(http.StatusNotFound, resp, t)
+
+	resp = sendRequest(t, "DELETE", s.URL+"/admin/records/web01.example.com", "", "provisioner")
+	resp.Body.Close()
+	assertStatus(http.StatusNotFound, resp, t)
+
+	// The values of a removed record aren't served if it is added again
+	resp = sendRequest(t, "POST", s.URL+"/admin/records", `{"fqdn": "web01.example.com", "allowed": ["user-other"]}`, "provisioner")
+	resp.Body.Close()
+	assertStatus(http.StatusCreated, resp, t)
+	if values := valuesOf(t, tt.records["_acme-challenge.web01.example.com."]); len(values) != 0 {
+		t.Errorf("Expected no values, got %v", values)
+	}
+}
+
+func TestAdminErrors(t *testing.T) {
+	tt := newAdminTempTxt(t)
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		user   string
+		want   int
+	}{
+		{method: "GET", path: "/admin/records", user: "", want: http.StatusUnauthorized},
+		{method: "GET", path: "/admin/records", user: "user1", want: http.StatusForbidden},
+		{method: "DELETE", path: "/admin/records/static.example.com", user: "user1", want: http.StatusForbidden},
+		{method: "PUT", path: "/admin/records", user: "provisioner", want: http.StatusMethodNotAllowed},
+		{method: "GET", path: "/admin/records/static.example.com", user: "provisioner", want: http.StatusMethodNotAllowed},
+		{method: "POST", path: "/admin/records", body: "invalid", user: "provisioner", want: http.StatusBadRequest},
+		{method: "POST", path: "/admin/records", body: `{"fqdn": "test.example.com"}`, user: "provisioner", want: http.StatusBadRequest},
+		{method: "POST", path: "/admin/records", body: `{"fqdn": "static.example.com", "allowed": ["user2"]}`, user: "provisioner", want: http.StatusConflict},
+		{method: "POST", path: "/admin/records", body: `{"fqdn": "other.example.com", "alias": "_acme-challenge.static.example.com", "allowed": ["user2"]}`, user: "provisioner", want: http.StatusBadRequest},
+		{method: "DELETE", path: "/admin/records/", user: "provisioner", want: http.StatusBadRequest},
+	}
+
+	for i, tc := range tests {
+		resp := sendRequest(t, tc.method, s.URL+tc.path, tc.body, tc.user)
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("[%d] Expected status code %d, got %d", i, tc.want, resp.StatusCode)
+		}
+	}
+}
+
+// The admin API is only available if admin is set.
+func TestAdminDisabled(t *testing.T) {
+	tt := newTestTempTxt(t)
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	resp := sendRequest(t, "GET", s.URL+"/admin/records", "", "provisioner")
+	resp.Body.Close()
+	assertStatus(http.StatusNotFound, resp, t)
+}
+
+// Queries should be safe while records are added and removed.
+func TestAdminConcurrent(t *testing.T) {
+	tt := newAdminTempTxt(t)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			tt.mtx.Lock()
+			tt.addRecordLocked(recordDef{FQDN: "web01.example.com", Allowed: []string{"user1"}})
+			tt.mtx.Unlock()
+			tt.mtx.Lock()
+			tt.removeRecordLocked("web01.example.com")
+			tt.mtx.Unlock()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			req := new(dns.Msg)
+			req.SetQuestion("_acme-challenge.web01.example.com.", dns.TypeTXT)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			tt.ServeDNS(context.Background(), rec, req)
+		}
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,162 @@
+package temptxt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditSyslog is the audit destination that writes to the local syslog daemon.
+const auditSyslog = "syslog"
+
+// Sources of audit entries.
+const (
+	auditSourceAPI     = "api"
+	auditSourceLego    = "lego"
+	auditSourceAcmeDNS = "acme-dns"
+	auditSourceRFC2136 = "rfc2136"
+	auditSourceAdmin   = "admin"
+	auditSourceClean   = "clean"
+)
+
+// auditEntry is a single line of the audit log.
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	// Source is the API or process that made the change.
+	Source     string `json:"source"`
+	User       string `json:"user,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// FQDN is the name given in the request.
+	FQDN string `json:"fqdn,omitempty"`
+	// Record is the FQDN the record is served at, after resolving any alias.
+	Record string `json:"record,omitempty"`
+	Action string `json:"action,omitempty"`
+	// Only one of Value and ValueSHA256 is set depending on the configuration.
+	Value       string `json:"value,omitempty"`
+	ValueSHA256 string `json:"value_sha256,omitempty"`
+	// Status is the HTTP status code of API requests.
+	Status int `json:"status,omitempty"`
+	// Rcode is the response code of RFC 2136 updates.
+	Rcode string `json:"rcode,omitempty"`
+	// Removed is the number of values removed by the cleaner.
+	Removed int `json:"removed,omitempty"`
+	// Prev is the hex encoded SHA256 of the previous line so that
+	// changed or removed lines can be detected.
+	Prev string `json:"prev,omitempty"`
+}
+
+// auditLog writes audit entries as JSON lines.
+type auditLog struct {
+	mtx sync.Mutex
+	w   io.WriteCloser
+	// hash is set if values are replaced with their SHA256 hash.
+	hash bool
+	// prev is the hash of the last line written.
+	prev string
+}
+
+// newAuditLog returns an audit log that appends to the file dest,
+// or writes to syslog if dest is auditSyslog.
+func newAuditLog(dest string, hash bool) (*auditLog, error) {
+	if dest == auditSyslog {
+		w, err := newSyslogWriter()
+		if err != nil {
+			return nil, err
+		}
+		return &auditLog{w: w, hash: hash}, nil
+	}
+
+	f, err := os.OpenFile(dest, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	// Continue the chain of the existing lines
+	last, err := lastLine(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a := &auditLog{w: f, hash: hash}
+	if len(last) > 0 {
+		a.prev = lineHash(last)
+	}
+	return a, nil
+}
+
+// lastLine returns the last line of f without the newline.
+func lastLine(f *os.File) ([]byte, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var tail []byte
+	buf := make([]byte, 4096)
+	for off := fi.Size(); off > 0; {
+		n := int64(len(buf))
+		if off < n {
+			n = off
+		}
+		off -= n
+		if _, err := f.ReadAt(buf[:n], off); err != nil {
+			return nil, err
+		}
+		tail = append(append([]byte(nil), buf[:n]...), tail...)
+		tail = bytes.TrimRight(tail, "\n")
+		if i := bytes.LastIndexByte(tail, '\n'); i != -1 {
+			return tail[i+1:], nil
+		}
+	}
+	return tail, nil
+}
+
+// lineHash returns the hex encoded SHA256 of a line without the newline.
+func lineHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// write writes e to the log. Errors are logged since the change has already been made.
+func (a *auditLog) write(e auditEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if a.hash && e.Value != "" {
+		sum := sha256.Sum256([]byte(e.Value))
+		e.ValueSHA256 = hex.EncodeToString(sum[:])
+		e.Value = ""
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	e.Prev = a.prev
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("Error encoding audit entry: %v", err)
+		return
+	}
+	if _, err := a.w.Write(append(b, '\n')); err != nil {
+		log.Errorf("Error writing audit entry: %v", err)
+		return
+	}
+	a.prev = lineHash(b)
+}
+
+// Close closes the underlying file or syslog connection.
+func (a *auditLog) Close() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.w.Close()
+}
+
+// audit writes e to the audit log if one is configured.
+func (tt *TempTxt) audit(e auditEntry) {
+	if tt.auditLog != nil {
+		tt.auditLog.write(e)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package temptxt
+
+import (
+	"errors"
+	"io"
+)
+
+// newSyslogWriter returns an error since log/syslog is not available.
+func newSyslogWriter() (io.WriteCloser, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,14 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package temptxt
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// newSyslogWriter returns a writer to the local syslog daemon.
+func newSyslogWriter() (io.WriteCloser, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, "temptxt")
+}
@@ -0,0 +1,283 @@
+package temptxt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+// newTestAuditLog returns an audit log writing to a file in a temporary directory and its path.
+func newTestAuditLog(t *testing.T, hash bool) (*auditLog, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := newAuditLog(path, hash)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { a.Close() })
+	return a, path
+}
+
+func newAuditTempTxt(t *testing.T, hash bool) (*TempTxt, string) {
+	t.Helper()
+	tt := newTestTempTxt(t, testRecordDef)
+	a, path := newTestAuditLog(t, hash)
+	tt.auditLog = a
+	return tt, path
+}
+
+// verifyAuditChain returns an error if the prev hash of a line
+// isn't the hash of the line before it.
+func verifyAuditChain(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	var prev string
+	for i := 1; scanner.Scan(); i++ {
+		e := auditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("line %d: %v", i, err)
+		}
+		// The first line can continue a log that was rotated
+		if i > 1 && e.Prev != prev {
+			return fmt.Errorf("line %d: expected prev %q, got %q", i, prev, e.Prev)
+		}
+		prev = lineHash(scanner.Bytes())
+	}
+	return scanner.Err()
+}
+
+// readAudit returns the entries in the audit log at path without the prev hashes.
+// The test fails if the chain of hashes is broken.
+func readAudit(t *testing.T, path string) []auditEntry {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading audit log: %v", err)
+	}
+	if err := verifyAuditChain(bytes.NewReader(b)); err != nil {
+		t.Errorf("Invalid audit log: %v", err)
+	}
+
+	var entries []auditEntry
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		e := auditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("Invalid audit line %q: %v", scanner.Text(), err)
+		}
+		e.Prev = ""
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAuditUpdate(t *testing.T) {
+	tt, path := newAuditTempTxt(t, false)
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	for _, tc := range []struct {
+		body string
+		user string
+	}{
+		{body: `{"fqdn": "test1.example.com", "content": "a"}`, user: "user1"},
+		{body: `{"fqdn": "test1.example.com", "content": "a", "action": "remove"}`, user: "user2"},
+		{body: `{"fqdn": "test1.example.com"}`, user: "user1"},
+		{body: `{"fqdn": "test1.example.com", "content": "a"}`, user: ""},
+	} {
+		resp := sendRequest(t, "PUT", s.URL+"/update", tc.body, tc.user)
+		resp.Body.Close()
+	}
+
+	want := []auditEntry{
+		{Source: auditSourceAPI, User: "user1", FQDN: "test1.example.com.", Record: "_acme-challenge.test1.example.com.", Action: ActionAdd, Value: "a", Status: http.StatusNoContent},
+		{Source: auditSourceAPI, User: "user2", FQDN: "test1.example.com.", Record: "_acme-challenge.test1.example.com.", Action: ActionRemove, Value: "a", Status: http.StatusForbidden},
+		{Source: auditSourceAPI, User: "user1", FQDN: "test1.example.com.", Record: "_acme-challenge.test1.example.com.", Action: ActionClear, Status: http.StatusNoContent},
+		{Source: auditSourceAPI, Status: http.StatusUnauthorized},
+	}
+	entries := readAudit(t, path)
+	if len(entries) != len(want) {
+		t.Fatalf("Expected %d entries, got %d: %+v", len(want), len(entries), entries)
+	}
+	for i, e := range entries {
+		if e.Time.IsZero() || e.RemoteAddr == "" {
+			t.Errorf("[%d] Expected the time and remote address to be set: %+v", i, e)
+		}
+		e.Time, e.RemoteAddr = time.Time{}, ""
+		if e != want[i] {
+			t.Errorf("[%d] Expected %+v, got %+v", i, want[i], e)
+		}
+	}
+}
+
+// Values should be replaced with their hash.
+func TestAuditHash(t *testing.T) {
+	tt, path := newAuditTempTxt(t, true)
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	resp := sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "test1.example.com", "content": "a"}`, "user1")
+	resp.Body.Close()
+
+	entries := readAudit(t, path)
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(entries))
+	}
+	// echo -n a | sha256sum
+	if want := "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb"; entries[0].ValueSHA256 != want || entries[0].Value != "" {
+		t.Errorf("Expected only the hash %q, got %+v", want, entries[0])
+	}
+}
+
+func TestAuditClean(t *testing.T) {
+	tt, path := newAuditTempTxt(t, false)
+	tt.cleanInterval = 10 * time.Millisecond
+	setStates(t, tt.store, map[string]RecordState{
+		"_acme-challenge.test1.example.com.": {Values: []Value{{Txt: "a"}}, Updated: time.Now().Add(-5 * time.Minute)},
+	})
+	tt.setModified()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tt.Run(ctx)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	entries := readAudit(t, path)
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(entries))
+	}
+	want := auditEntry{Source: auditSourceClean, Record: "_acme-challenge.test1.example.com.", Action: "expire", Removed: 1}
+	e := entries[0]
+	if e.Time.IsZero() {
+		t.Errorf("Expected the time to be set")
+	}
+	e.Time = time.Time{}
+	if e != want {
+		t.Errorf("Expected %+v, got %+v", want, e)
+	}
+}
+
+// Changed and removed lines should break the chain of hashes, also across restarts.
+func TestAuditChain(t *testing.T) {
+	a, path := newTestAuditLog(t, false)
+	for _, v := range []string{"a", "b"} {
+		a.write(auditEntry{Source: auditSourceAPI, Action: ActionAdd, Value: v})
+	}
+	a.Close()
+	a, err := newAuditLog(path, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, v := range []string{"c", "d"} {
+		a.write(auditEntry{Source: auditSourceAPI, Action: ActionAdd, Value: v})
+	}
+	a.Close()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading audit log: %v", err)
+	}
+	if err := verifyAuditChain(bytes.NewReader(b)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	if len(lines) != 5 || lines[4] != "" {
+		t.Fatalf("Expected 4 lines, got %q", b)
+	}
+
+	tests := map[string]string{
+		"changed": lines[0] + strings.Replace(lines[1], `"value":"b"`, `"value":"x"`, 1) + lines[2] + lines[3],
+		"removed": lines[0] + lines[2] + lines[3],
+		"swapped": lines[0] + lines[2] + lines[1] + lines[3],
+	}
+	for name, data := range tests {
+		if err := verifyAuditChain(strings.NewReader(data)); err == nil {
+			t.Errorf("[%s] Expected error but got nil", name)
+		}
+	}
+}
+
+// Rejected RFC 2136 updates should be audited.
+func TestAuditUpdateRejected(t *testing.T) {
+	tests := []struct {
+		zone string
+		rr   string
+		key  string
+		// limit sets a rate limit that has been reached
+		limit bool
+		want  auditEntry
+	}{
+		{
+			zone: "example.com.", rr: `_acme-challenge.test2.example.com. 60 IN TXT "a"`, key: "key1.",
+			want: auditEntry{User: "user1", FQDN: "_acme-challenge.test2.example.com.", Record: "_acme-challenge.test2.example.com.", Rcode: "REFUSED"},
+		},
+		{
+			zone: "example.com.", rr: `_acme-challenge.test1.example.com. 60 IN TXT "a"`, key: "key2.",
+			want: auditEntry{FQDN: "example.com.", Rcode: "NOTAUTH"},
+		},
+		{
+			zone: "example.com.", rr: `_acme-challenge.test1.example.com. 60 IN TXT "a"`,
+			want: auditEntry{FQDN: "example.com.", Rcode: "REFUSED"},
+		},
+		{
+			zone: "example.org.", rr: `_acme-challenge.test1.example.com. 60 IN TXT "a"`, key: "key1.",
+			want: auditEntry{User: "user1", FQDN: "_acme-challenge.test1.example.com.", Rcode: "NOTZONE"},
+		},
+		{
+			zone: "example.com.", rr: `_acme-challenge.test1.example.com. 60 IN TXT "` + strings.Repeat("a", defaultMaxValueLength+1) + `"`, key: "key1.",
+			want: auditEntry{User: "user1", FQDN: "_acme-challenge.test1.example.com.", Record: "_acme-challenge.test1.example.com.", Rcode: "FORMERR"},
+		},
+		{
+			zone: "example.com.", rr: `_acme-challenge.test1.example.com. 60 IN TXT "a"`, key: "key1.", limit: true,
+			want: auditEntry{User: "user1", FQDN: "example.com.", Rcode: "REFUSED"},
+		},
+	}
+
+	for i, tc := range tests {
+		tt := newUpdateTempTxt(t)
+		a, path := newTestAuditLog(t, false)
+		tt.auditLog = a
+		if tc.limit {
+			tt.rateLimit = newRateLimiter(1)
+			tt.rateLimit.allow("user1")
+		}
+
+		m := new(dns.Msg)
+		m.SetUpdate(tc.zone)
+		m.Insert([]dns.RR{test.TXT(tc.rr)})
+		req := m
+		if tc.key != "" {
+			req = signedUpdate(t, m, tc.key, testTsigSecret, false)
+		}
+		if code := sendUpdate(t, tt, req); code == dns.RcodeSuccess {
+			t.Errorf("[%d] Expected the update to be rejected", i)
+		}
+
+		entries := readAudit(t, path)
+		if len(entries) != 1 {
+			t.Errorf("[%d] Expected 1 entry, got %d: %+v", i, len(entries), entries)
+			continue
+		}
+		e := entries[0]
+		if e.Time.IsZero() || e.RemoteAddr == "" {
+			t.Errorf("[%d] Expected the time and remote address to be set: %+v", i, e)
+		}
+		e.Time, e.RemoteAddr = time.Time{}, ""
+		tc.want.Source = auditSourceRFC2136
+		if e != tc.want {
+			t.Errorf("[%d] Expected %+v, got %+v", i, tc.want, e)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package temptxt
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const defaultAuthReload = 5 * time.Second
+
+// auth authenticates users with htpasswd style bcrypt passwords
+// or static bearer tokens.
+type auth struct {
+	htpasswdFile string
+	tokensFile   string
+	reload       time.Duration
+
+	mtx sync.RWMutex
+	// users maps a username to a bcrypt hash.
+	users map[string][]byte
+	// dummyHash is compared for unknown users so that the response time
+	// doesn't show which users exist. It has the highest cost of the users' hashes.
+	dummyHash []byte
+	// tokens maps the SHA256 hash of a token to a username.
+	tokens map[[sha256.Size]byte]string
+
+	htpasswdMod fileMod
+	tokensMod   fileMod
+}
+
+// fileMod is used to detect changes to a file.
+type fileMod struct {
+	mtime time.Time
+	size  int64
+}
+
+// user returns the user authenticated by the Authorization header of r or "".
+func (a *auth) user(r *http.Request) string {
+	if user, pass, ok := r.BasicAuth(); ok {
+		a.mtx.RLock()
+		hash, ok := a.users[user]
+		if !ok {
+			hash = a.dummyHash
+		}
+		a.mtx.RUnlock()
+		if bcrypt.CompareHashAndPassword(hash, []byte(pass)) == nil && ok {
+			return user
+		}
+		return ""
+	}
+
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token := strings.TrimPrefix(h, "Bearer ")
+		a.mtx.RLock()
+		defer a.mtx.RUnlock()
+		return a.tokens[sha256.Sum256([]byte(token))]
+	}
+
+	return ""
+}
+
+// load reads the files if they have changed since they were last read.
+func (a *auth) load() error {
+	if a.htpasswdFile != "" {
+		changed, err := a.htpasswdMod.changed(a.htpasswdFile)
+		if err != nil {
+			return err
+		}
+		if changed {
+			users := make(map[string][]byte)
+			cost := bcrypt.MinCost
+			err := readPairs(a.htpasswdFile, func(user string, hash string) error {
+				c, err := bcrypt.Cost([]byte(hash))
+				if err != nil {
+					return fmt.Errorf("password for user %q is not a bcrypt hash", user)
+				}
+				if c > cost {
+					cost = c
+				}
+				users[user] = []byte(hash)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			dummyHash, err := bcrypt.GenerateFromPassword([]byte("dummy"), cost)
+			if err != nil {
+				return err
+			}
+			a.mtx.Lock()
+			a.users = users
+			a.dummyHash = dummyHash
+			a.mtx.Unlock()
+		}
+	}
+
+	if a.tokensFile != "" {
+		changed, err := a.tokensMod.changed(a.tokensFile)
+		if err != nil {
+			return err
+		}
+		if changed {
+			tokens := make(map[[sha256.Size]byte]string)
+			err := readPairs(a.tokensFile, func(user string, token string) error {
+				tokens[sha256.Sum256([]byte(token))] = user
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			a.mtx.Lock()
+			a.tokens = tokens
+			a.mtx.Unlock()
+		}
+	}
+
+	return nil
+}
+
+// Run reloads the files when they change.
+func (a *auth) Run(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(a.reload)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := a.load(); err != nil {
+					log.Errorf("Error reloading auth files: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// changed returns true if the file has changed since the last call.
+func (m *fileMod) changed(path string) (bool, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if stat.ModTime().Equal(m.mtime) && stat.Size() == m.size {
+		return false, nil
+	}
+	m.mtime = stat.ModTime()
+	m.size = stat.Size()
+	return true, nil
+}
+
+// readPairs calls fn for every "USER:VALUE" line in path.
+// Empty lines and lines starting with # are skipped.
+func readPairs(path string, fn func(string, string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		split := strings.SplitN(text, ":", 2)
+		if len(split) != 2 || split[0] == "" || split[1] == "" {
+			return fmt.Errorf("%s:%d: expected USER:VALUE", path, line)
+		}
+		if err := fn(split[0], split[1]); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,166 @@
+package temptxt
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestAuth(t *testing.T) (*auth, string) {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("password1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+
+	dir := t.TempDir()
+	htpasswd := writeFile(t, dir, "htpasswd", []byte("# comment\n\nuser1:"+string(hash)+"\n"))
+	tokens := writeFile(t, dir, "tokens", []byte("user2:token2\n"))
+
+	a := &auth{htpasswdFile: htpasswd, tokensFile: tokens, reload: 10 * time.Millisecond}
+	if err := a.load(); err != nil {
+		t.Fatalf("Unexpected error loading: %v", err)
+	}
+	return a, tokens
+}
+
+func TestAuthUser(t *testing.T) {
+	a, _ := newTestAuth(t)
+
+	tests := []struct {
+		user     string
+		password string
+		token    string
+		header   string
+		want     string
+	}{
+		{user: "user1", password: "password1", want: "user1"},
+		{user: "user1", password: "invalid"},
+		{user: "user2", password: "token2"},
+		{user: "unknown", password: "dummy"},
+		{token: "token2", want: "user2"},
+		{token: "invalid"},
+		{header: "Other token2"},
+		{},
+	}
+
+	for i, tc := range tests {
+		r, err := http.NewRequest("PUT", "/update", nil)
+		if err != nil {
+			t.Fatalf("[%d] Error creating request: %v", i, err)
+		}
+		switch {
+		case tc.user != "":
+			r.SetBasicAuth(tc.user, tc.password)
+		case tc.token != "":
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		case tc.header != "":
+			r.Header.Set("Authorization", tc.header)
+		}
+		if have := a.user(r); have != tc.want {
+			t.Errorf("[%d] Expected user %q, got %q", i, tc.want, have)
+		}
+	}
+}
+
+// Unknown users should be compared against a hash with the same cost.
+func TestAuthDummyHash(t *testing.T) {
+	a, _ := newTestAuth(t)
+	cost, err := bcrypt.Cost(a.dummyHash)
+	if err != nil {
+		t.Fatalf("Invalid dummy hash: %v", err)
+	}
+	if want, _ := bcrypt.Cost(a.users["user1"]); cost != want {
+		t.Errorf("Expected cost %d, got %d", want, cost)
+	}
+}
+
+func TestAuthReload(t *testing.T) {
+	a, tokens := newTestAuth(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a.Run(ctx)
+
+	if err := os.WriteFile(tokens, []byte("user3:token3\n"), 0o600); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+
+	r, err := http.NewRequest("PUT", "/update", nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	r.Header.Set("Authorization", "Bearer token3")
+
+	deadline := time.Now().Add(time.Second)
+	for a.user(r) != "user3" {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected tokens to be reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	r.Header.Set("Authorization", "Bearer token2")
+	if have := a.user(r); have != "" {
+		t.Errorf("Expected old token to be removed, got user %q", have)
+	}
+}
+
+func TestAuthLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []*auth{
+		{htpasswdFile: writeFile(t, dir, "plain", []byte("user1:password\n"))},
+		{htpasswdFile: writeFile(t, dir, "nocolon", []byte("user1\n"))},
+		{tokensFile: writeFile(t, dir, "empty", []byte("user1:\n"))},
+		{tokensFile: dir + "/missing"},
+	}
+	for i, a := range tests {
+		if err := a.load(); err == nil {
+			t.Errorf("[%d] Expected error but got nil", i)
+		}
+	}
+}
+
+func TestAuthConfig(t *testing.T) {
+	_, tokens := newTestAuth(t)
+
+	c := caddy.NewTestController("dns", `temptxt {
+	auth {
+		tokens `+tokens+`
+		reload 1m
+	}
+	max_age 5m
+}`)
+	tt, err := parseConfig(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if tt.auth == nil {
+		t.Fatal("Expected auth to be set")
+	}
+	if tt.auth.reload != time.Minute {
+		t.Errorf("Expected reload %s, got %s", time.Minute, tt.auth.reload)
+	}
+	if tt.maxAge != 5*time.Minute {
+		t.Errorf("Expected max_age %s, got %s", 5*time.Minute, tt.maxAge)
+	}
+
+	// The auth header should be ignored
+	r, err := http.NewRequest("PUT", "/update", nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	r.Header.Set(defaultAuthHeader, "user1")
+	if have := tt.requestUser(r); have != "" {
+		t.Errorf("Expected no user, got %q", have)
+	}
+	r.Header.Set("Authorization", "Bearer token2")
+	if have := tt.requestUser(r); have != "user2" {
+		t.Errorf("Expected user %q, got %q", "user2", have)
+	}
+}
@@ -0,0 +1,59 @@
+package temptxt
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/dnssec"
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// signatureCacheSize is the number of signatures that are cached.
+const signatureCacheSize = 10000
+
+// newSigner returns a signer for zone using the keys in files.
+// Each file is the base name of a key (eg. Kexample.org.+013+45330) with
+// or without the .key or .private extension.
+func newSigner(zone string, files []string) (*dnssec.Dnssec, []*dnssec.DNSKEY, error) {
+	keys := make([]*dnssec.DNSKEY, 0, len(files))
+	for _, f := range files {
+		base := strings.TrimSuffix(strings.TrimSuffix(f, ".key"), ".private")
+		k, err := dnssec.ParseKeyFile(base+".key", base+".private")
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading key %q: %v", base, err)
+		}
+		if name := strings.ToLower(k.K.Hdr.Name); name != zone {
+			return nil, nil, fmt.Errorf("key %q is for %q, not %q", base, name, zone)
+		}
+		keys = append(keys, k)
+	}
+
+	d := dnssec.New([]string{zone}, keys, false, nil, cache.New(signatureCacheSize))
+	return &d, keys, nil
+}
+
+// dnskeys returns the DNSKEY records for the zone.
+func (tt *TempTxt) dnskeys() []dns.RR {
+	rrs := make([]dns.RR, len(tt.keys))
+	for i, k := range tt.keys {
+		rr := dns.Copy(k.K)
+		rr.Header().Ttl = tt.soa.Hdr.Ttl
+		rrs[i] = rr
+	}
+	return rrs
+}
+
+// sign signs m if DNSSEC is enabled and the client set the DO bit.
+// Negative answers are turned into NODATA answers with NSEC black lies.
+func (tt *TempTxt) sign(ctx context.Context, state request.Request, m *dns.Msg) *dns.Msg {
+	if tt.signer == nil || !state.Do() {
+		return m
+	}
+	signState := request.Request{W: state.W, Req: m, Zone: tt.soa.Hdr.Name}
+	return tt.signer.Sign(signState, time.Now().UTC(), metrics.WithServer(ctx))
+}
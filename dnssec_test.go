@@ -0,0 +1,216 @@
+package temptxt
+
+import (
+	"context"
+	"crypto"
+	"path/filepath"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+// newTestKey writes a new key for zone to dir and returns the base name of the files.
+func newTestKey(t *testing.T, dir string, zone string) (string, *dns.DNSKEY) {
+	t.Helper()
+	k := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := k.Generate(256)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	base := filepath.Join(dir, "K"+zone)
+	writeFile(t, dir, "K"+zone+".key", []byte(k.String()+"\n"))
+	writeFile(t, dir, "K"+zone+".private", []byte(k.PrivateKeyString(priv.(crypto.PrivateKey))))
+	return base, k
+}
+
+func newDNSSECTempTxt(t *testing.T) (*TempTxt, *dns.DNSKEY) {
+	t.Helper()
+	base, key := newTestKey(t, t.TempDir(), "acme.example.com.")
+	c := caddy.NewTestController("dns", `temptxt {
+	soa acme.example.com
+	ttl 30
+	dnssec `+base+`
+	txt _acme-challenge.www.acme.example.com user1
+	txt _acme-challenge.empty.acme.example.com user1
+}`)
+	tt, err := parseConfig(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tt.Next = testHandler()
+	if err := tt.records["_acme-challenge.www.acme.example.com."].add(Value{Txt: "www"}, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return tt, key
+}
+
+func dnssecQuery(t *testing.T, tt *TempTxt, qname string, qtype uint16, do bool) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(qname, qtype)
+	req.SetEdns0(4096, do)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := tt.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	return rec.Msg
+}
+
+// verifySigs checks that every RRset in rrs is covered by a valid RRSIG.
+func verifySigs(t *testing.T, key *dns.DNSKEY, section string, rrs []dns.RR) {
+	t.Helper()
+	sets := make(map[uint16][]dns.RR)
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+			continue
+		}
+		sets[rr.Header().Rrtype] = append(sets[rr.Header().Rrtype], rr)
+	}
+	if len(sets) == 0 {
+		t.Errorf("Expected records in the %s section", section)
+	}
+	for rrtype, set := range sets {
+		verified := false
+		for _, sig := range sigs {
+			if sig.TypeCovered == rrtype && sig.Verify(key, set) == nil {
+				verified = true
+			}
+		}
+		if !verified {
+			t.Errorf("No valid RRSIG for %s in the %s section", dns.TypeToString[rrtype], section)
+		}
+	}
+}
+
+func TestDNSSECAnswer(t *testing.T) {
+	tt, key := newDNSSECTempTxt(t)
+
+	for _, qtype := range []uint16{dns.TypeTXT, dns.TypeDNSKEY, dns.TypeSOA} {
+		qname := "acme.example.com."
+		if qtype == dns.TypeTXT {
+			qname = "_acme-challenge.www.acme.example.com."
+		}
+		m := dnssecQuery(t, tt, qname, qtype, true)
+		if m.Rcode != dns.RcodeSuccess {
+			t.Errorf("[%s] Expected rcode %s, but got %s", dns.TypeToString[qtype], dns.RcodeToString[dns.RcodeSuccess], dns.RcodeToString[m.Rcode])
+		}
+		verifySigs(t, key, "answer", m.Answer)
+	}
+}
+
+func TestDNSSECDenial(t *testing.T) {
+	tt, key := newDNSSECTempTxt(t)
+
+	tests := []struct {
+		qname string
+		qtype uint16
+	}{
+		// NODATA
+		{qname: "_acme-challenge.empty.acme.example.com.", qtype: dns.TypeTXT},
+		{qname: "_acme-challenge.www.acme.example.com.", qtype: dns.TypeA},
+		// NXDOMAIN
+		{qname: "unknown.acme.example.com.", qtype: dns.TypeTXT},
+	}
+
+	for i, tc := range tests {
+		m := dnssecQuery(t, tt, tc.qname, tc.qtype, true)
+		// Black lies turn NXDOMAIN into NODATA
+		if m.Rcode != dns.RcodeSuccess {
+			t.Errorf("[%d] Expected rcode %s, but got %s", i, dns.RcodeToString[dns.RcodeSuccess], dns.RcodeToString[m.Rcode])
+		}
+		if len(m.Answer) != 0 {
+			t.Errorf("[%d] Expected no answers, got %v", i, m.Answer)
+		}
+		verifySigs(t, key, "authority", m.Ns)
+
+		found := false
+		for _, rr := range m.Ns {
+			nsec, ok := rr.(*dns.NSEC)
+			if !ok {
+				continue
+			}
+			found = true
+			if nsec.Hdr.Name != tc.qname {
+				t.Errorf("[%d] Expected NSEC for %q, got %q", i, tc.qname, nsec.Hdr.Name)
+			}
+			for _, bit := range nsec.TypeBitMap {
+				if bit == tc.qtype {
+					t.Errorf("[%d] Expected %s to not be in the NSEC bitmap", i, dns.TypeToString[tc.qtype])
+				}
+			}
+		}
+		if !found {
+			t.Errorf("[%d] Expected a NSEC record", i)
+		}
+	}
+}
+
+// Responses should not be signed unless the DO bit is set.
+func TestDNSSECNoDO(t *testing.T) {
+	tt, _ := newDNSSECTempTxt(t)
+
+	m := dnssecQuery(t, tt, "_acme-challenge.www.acme.example.com.", dns.TypeTXT, false)
+	for _, rr := range append(m.Answer, m.Ns...) {
+		if rr.Header().Rrtype == dns.TypeRRSIG || rr.Header().Rrtype == dns.TypeNSEC {
+			t.Errorf("Unexpected %s", rr)
+		}
+	}
+
+	m = dnssecQuery(t, tt, "unknown.acme.example.com.", dns.TypeTXT, false)
+	if m.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected rcode %s, but got %s", dns.RcodeToString[dns.RcodeNameError], dns.RcodeToString[m.Rcode])
+	}
+}
+
+func TestDNSSECConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	base, _ := newTestKey(t, dir, "other.example.com.")
+
+	tests := []string{
+		// No soa
+		`temptxt {
+	dnssec ` + base + `
+}`,
+		// Key for a different zone
+		`temptxt {
+	soa acme.example.com
+	dnssec ` + base + `
+}`,
+		// Missing key
+		`temptxt {
+	soa acme.example.com
+	dnssec ` + filepath.Join(dir, "missing") + `
+}`,
+		// No key
+		`temptxt {
+	soa acme.example.com
+	dnssec
+}`,
+	}
+
+	for i, body := range tests {
+		c := caddy.NewTestController("dns", body)
+		if _, err := parseConfig(c); err == nil {
+			t.Errorf("[%d] Expected error but got nil", i)
+		}
+	}
+
+	// The .key extension is optional
+	c := caddy.NewTestController("dns", `temptxt {
+	soa other.example.com
+	dnssec `+base+`.key
+}`)
+	if _, err := parseConfig(c); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
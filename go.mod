@@ -3,7 +3,12 @@ module github.com/devon-mar/temptxt
 go 1.16
 
 require (
+	github.com/alicebob/miniredis/v2 v2.14.5
 	github.com/coredns/caddy v1.1.1
 	github.com/coredns/coredns v1.8.6
+	github.com/go-redis/redis/v8 v8.11.5
 	github.com/miekg/dns v1.1.43
+	github.com/prometheus/client_golang v1.11.0
+	golang.org/x/crypto v0.0.0-20210513164829-c07d793c2f9a
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
@@ -0,0 +1,168 @@
+package temptxt
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// legoBody is the body sent by the lego httpreq DNS provider.
+// FQDN and Value are set in the default mode.
+// Domain, Token and KeyAuth are set in RAW mode.
+type legoBody struct {
+	FQDN    string `json:"fqdn"`
+	Value   string `json:"value"`
+	Domain  string `json:"domain"`
+	Token   string `json:"token"`
+	KeyAuth string `json:"keyAuth"`
+}
+
+// legoRequest parses and authorizes a request from the lego httpreq provider.
+// It returns the record and the value to add or remove.
+// If the request is invalid, an error response is written.
+// The details of the request are added to entry for the audit log.
+func (tt *TempTxt) legoRequest(w http.ResponseWriter, r *http.Request, entry *auditEntry) (*Record, string, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return nil, "", false
+	}
+
+	user, ok := tt.getUser(w, r)
+	if !ok {
+		return nil, "", false
+	}
+	entry.User = user
+
+	if !tt.checkRate(w, user) {
+		return nil, "", false
+	}
+
+	lb := legoBody{}
+	if err := json.NewDecoder(r.Body).Decode(&lb); err != nil {
+		log.Errorf("error decoding json: %v", err)
+		http.Error(w, "error parsing body", http.StatusBadRequest)
+		return nil, "", false
+	}
+
+	var names []string
+	value := lb.Value
+	if lb.Domain != "" {
+		// RAW mode
+		if lb.KeyAuth == "" {
+			http.Error(w, "keyAuth cannot be empty", http.StatusBadRequest)
+			return nil, "", false
+		}
+		domain := dns.Fqdn(strings.ToLower(lb.Domain))
+		names = []string{"_acme-challenge." + domain, domain}
+		hash := sha256.Sum256([]byte(lb.KeyAuth))
+		value = base64.RawURLEncoding.EncodeToString(hash[:])
+	} else {
+		if lb.FQDN == "" {
+			http.Error(w, "fqdn cannot be empty", http.StatusBadRequest)
+			return nil, "", false
+		}
+		names = []string{dns.Fqdn(strings.ToLower(lb.FQDN))}
+	}
+
+	entry.FQDN, entry.Value = names[0], value
+	if value == "" {
+		http.Error(w, "value cannot be empty", http.StatusBadRequest)
+		return nil, "", false
+	}
+	if len(value) > tt.valueLimit() {
+		http.Error(w, "value is too long", http.StatusBadRequest)
+		return nil, "", false
+	}
+
+	record := tt.legoRecord(names, user)
+	if record != nil {
+		entry.Record = record.fqdn
+	}
+	if !authorize(w, record, names[0], user) {
+		return nil, "", false
+	}
+
+	log.Infof("Received lego %s for %q from user %q", r.URL.Path, names[0], user)
+
+	return record, value, true
+}
+
+// legoRecord returns the record for the first name that exists.
+// lego sends the FQDN that will be queried, which may be the name
+// of the record rather than the alias, so both are checked.
+// If none exist, a record is created from a matching pattern.
+func (tt *TempTxt) legoRecord(names []string, user string) *Record {
+	for _, n := range names {
+		if r, ok := tt.getAlias(n); ok {
+			return r
+		}
+		if r, ok := tt.getRecord(n); ok {
+			return r
+		}
+	}
+	for _, n := range names {
+		if r := tt.aliasOrPattern(n, user); r != nil {
+			return r
+		}
+		if r := tt.recordOrPattern(n, user); r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+func (tt *TempTxt) legoPresentHandler(w http.ResponseWriter, r *http.Request) {
+	sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	entry := auditEntry{Source: auditSourceLego, RemoteAddr: r.RemoteAddr, Action: ActionAdd}
+	defer func() { entry.Status = sr.status; tt.audit(entry) }()
+	w = sr
+
+	record, value, ok := tt.legoRequest(w, r, &entry)
+	if !ok {
+		return
+	}
+
+	err := tt.addValue(record, Value{Txt: value})
+	if writeLimitError(w, err) {
+		log.Errorf("Limit exceeded updating %q: %v", record.fqdn, err)
+		return
+	} else if err != nil {
+		log.Errorf("Error updating %q: %v", record.fqdn, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	tt.setModified()
+	tt.replicate(record)
+	tt.notify(webhookEvent{Action: ActionAdd, FQDN: entry.FQDN, Record: record.fqdn, User: entry.User, Value: value})
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (tt *TempTxt) legoCleanupHandler(w http.ResponseWriter, r *http.Request) {
+	sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	entry := auditEntry{Source: auditSourceLego, RemoteAddr: r.RemoteAddr, Action: ActionRemove}
+	defer func() { entry.Status = sr.status; tt.audit(entry) }()
+	w = sr
+
+	record, value, ok := tt.legoRequest(w, r, &entry)
+	if !ok {
+		return
+	}
+
+	removed, err := record.remove(value)
+	if err != nil {
+		log.Errorf("Error updating %q: %v", record.fqdn, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if removed {
+		tt.replicate(record)
+		tt.notify(webhookEvent{Action: ActionRemove, FQDN: entry.FQDN, Record: record.fqdn, User: entry.User, Value: value})
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,96 @@
+package temptxt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func legoRequest(t *testing.T, url string, user string, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest("POST", url, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if user != "" {
+		req.Header.Set("X-Forwarded-User", user)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestLegoErrors(t *testing.T) {
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	tests := []struct {
+		path string
+		user string
+		body string
+		want int
+	}{
+		{path: "/present", body: `{"fqdn": "_acme-challenge.test8.example.com.", "value": "a"}`, want: http.StatusUnauthorized},
+		{path: "/present", user: "test18", body: `invalid`, want: http.StatusBadRequest},
+		{path: "/present", user: "test18", body: `{"value": "a"}`, want: http.StatusBadRequest},
+		{path: "/present", user: "test18", body: `{"fqdn": "_acme-challenge.test8.example.com."}`, want: http.StatusBadRequest},
+		{path: "/present", user: "test18", body: `{"domain": "test8.example.com"}`, want: http.StatusBadRequest},
+		{path: "/present", user: "test18", body: `{"fqdn": "invalid.example.com.", "value": "a"}`, want: http.StatusNotFound},
+		{path: "/cleanup", user: "test10", body: `{"fqdn": "_acme-challenge.test8.example.com.", "value": "a"}`, want: http.StatusForbidden},
+	}
+
+	for i, tc := range tests {
+		resp := legoRequest(t, s.URL+tc.path, tc.user, tc.body)
+		if resp.StatusCode != tc.want {
+			t.Errorf("[%d] Expected status code %d, got %d", i, tc.want, resp.StatusCode)
+		}
+	}
+
+	resp, err := client.Get(s.URL + "/present")
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	assertStatus(http.StatusMethodNotAllowed, resp, t)
+}
+
+func TestLegoPresentAndCleanup(t *testing.T) {
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	record := tt.records["_acme-challenge.test8.example.com."]
+
+	// Default mode using the name of the record
+	resp := legoRequest(t, s.URL+"/present", "test18", `{"fqdn": "_acme-challenge.test8.example.com.", "value": "value1"}`)
+	assertStatus(http.StatusOK, resp, t)
+
+	// RAW mode
+	resp = legoRequest(t, s.URL+"/present", "test18", `{"domain": "test8.example.com", "token": "token", "keyAuth": "keyauth"}`)
+	assertStatus(http.StatusOK, resp, t)
+
+	hash := sha256.Sum256([]byte("keyauth"))
+	rawValue := base64.RawURLEncoding.EncodeToString(hash[:])
+	if want := []string{"value1", rawValue}; !reflect.DeepEqual(valuesOf(t, record), want) {
+		t.Errorf("Expected content %v, got %v", want, valuesOf(t, record))
+	}
+
+	// Default mode using the alias
+	resp = legoRequest(t, s.URL+"/cleanup", "test18", `{"fqdn": "test8.example.com.", "value": "value1"}`)
+	assertStatus(http.StatusOK, resp, t)
+	if want := []string{rawValue}; !reflect.DeepEqual(valuesOf(t, record), want) {
+		t.Errorf("Expected content %v, got %v", want, valuesOf(t, record))
+	}
+
+	resp = legoRequest(t, s.URL+"/cleanup", "test18", `{"domain": "test8.example.com", "token": "token", "keyAuth": "keyauth"}`)
+	assertStatus(http.StatusOK, resp, t)
+	if l := len(valuesOf(t, record)); l != 0 {
+		t.Errorf("Expected length 0, but got %d", l)
+	}
+}
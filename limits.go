@@ -0,0 +1,201 @@
+package temptxt
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// rateWindow is the period the rate limit applies to.
+	rateWindow = time.Minute
+	// defaultMaxValueLength allows DKIM keys of up to 4096 bits.
+	defaultMaxValueLength = 1024
+	// maxValueLengthLimit is the largest max_value_length that can be configured
+	// so that an answer with a few values always fits in a TCP message.
+	maxValueLengthLimit = 16384
+)
+
+// errTooManyValues is returned by Record.add if the record already holds the maximum number of values.
+var errTooManyValues = errors.New("too many values")
+
+// limitError is returned when a change would exceed one of the limits.
+type limitError struct {
+	msg string
+	// retryAfter is when the limit may no longer be exceeded or 0 if it isn't known.
+	retryAfter time.Duration
+}
+
+func (e *limitError) Error() string {
+	return e.msg
+}
+
+// writeLimitError writes a 429 response if err is a *limitError.
+// The Retry-After header is only set if the time is known.
+// It returns false if err is another error.
+func writeLimitError(w http.ResponseWriter, err error) bool {
+	var le *limitError
+	if !errors.As(err, &le) {
+		return false
+	}
+	if le.retryAfter > 0 {
+		w.Header().Set("Retry-After", retryAfterSeconds(le.retryAfter))
+	}
+	http.Error(w, le.msg, http.StatusTooManyRequests)
+	return true
+}
+
+// retryAfterSeconds returns d in whole seconds, rounded up and at least one.
+func retryAfterSeconds(d time.Duration) string {
+	s := int(math.Ceil(d.Seconds()))
+	if s < 1 {
+		s = 1
+	}
+	return strconv.Itoa(s)
+}
+
+// rateLimiter limits the number of update requests of each user in every rateWindow.
+type rateLimiter struct {
+	limit int
+	mtx   sync.Mutex
+	// windows are the start of the current window and the number of requests in it by user.
+	windows map[string]*userWindow
+}
+
+type userWindow struct {
+	start    time.Time
+	requests int
+}
+
+func newRateLimiter(limit int) *rateLimiter {
+	return &rateLimiter{limit: limit, windows: make(map[string]*userWindow)}
+}
+
+// allow counts a request from user. It returns false and how long until the next
+// window if the user has already made the maximum number of requests in the current window.
+func (rl *rateLimiter) allow(user string) (bool, time.Duration) {
+	now := time.Now()
+
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	uw, ok := rl.windows[user]
+	if !ok || now.Sub(uw.start) >= rateWindow {
+		// Forget the users that haven't made a request in the last window
+		for u, w := range rl.windows {
+			if now.Sub(w.start) >= rateWindow {
+				delete(rl.windows, u)
+			}
+		}
+		uw = &userWindow{start: now}
+		rl.windows[user] = uw
+	}
+	if uw.requests >= rl.limit {
+		return false, uw.start.Add(rateWindow).Sub(now)
+	}
+	uw.requests++
+	return true, 0
+}
+
+// checkRate counts an update request from user if a rate limit is configured.
+// If the user has exceeded the limit, a 429 response is written.
+func (tt *TempTxt) checkRate(w http.ResponseWriter, user string) bool {
+	if tt.rateLimit == nil {
+		return true
+	}
+	if ok, retryAfter := tt.rateLimit.allow(user); !ok {
+		log.Errorf("Rate limit exceeded by user %q", user)
+		writeLimitError(w, &limitError{msg: "too many requests", retryAfter: retryAfter})
+		return false
+	}
+	return true
+}
+
+// valueLimit returns the maximum length of a value.
+func (tt *TempTxt) valueLimit() int {
+	if tt.maxValueLength > 0 {
+		return tt.maxValueLength
+	}
+	return defaultMaxValueLength
+}
+
+// addValue adds v to r unless the record would hold more than maxValues values
+// or the records would hold more than maxBytes in total.
+// A *limitError is returned if a limit would be exceeded.
+func (tt *TempTxt) addValue(r *Record, v Value) error {
+	unlock, err := tt.lockBytes(len(v.Txt))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = r.add(v, tt.maxValues)
+	if !errors.Is(err, errTooManyValues) {
+		return err
+	}
+	s, err := r.state()
+	if err != nil {
+		return err
+	}
+	return &limitError{msg: "too many values", retryAfter: tt.untilExpired(oldestValue(s.Values))}
+}
+
+// lockBytes returns a *limitError if adding n bytes would exceed maxBytes.
+// Otherwise the caller must call unlock once the value is added,
+// so that values added at the same time can't exceed maxBytes together.
+func (tt *TempTxt) lockBytes(n int) (unlock func(), err error) {
+	if tt.maxBytes == 0 {
+		return func() {}, nil
+	}
+	tt.bytesMtx.Lock()
+	if err := tt.checkBytes(n); err != nil {
+		tt.bytesMtx.Unlock()
+		return nil, err
+	}
+	return tt.bytesMtx.Unlock, nil
+}
+
+// checkBytes returns a *limitError if adding n bytes would exceed maxBytes.
+// The sizes of the records are the ones they had when they were last read
+// from or written to the store, so the store isn't read again.
+func (tt *TempTxt) checkBytes(n int) error {
+	tt.mtx.RLock()
+	total := n
+	var oldest time.Time
+	for _, r := range tt.records {
+		size, o := r.getSize()
+		total += size
+		if !o.IsZero() && (oldest.IsZero() || o.Before(oldest)) {
+			oldest = o
+		}
+	}
+	tt.mtx.RUnlock()
+
+	if total > tt.maxBytes {
+		return &limitError{msg: "too many bytes stored", retryAfter: tt.untilExpired(oldest)}
+	}
+	return nil
+}
+
+// oldestValue returns the creation time of the oldest of values.
+func oldestValue(values []Value) time.Time {
+	var oldest time.Time
+	for _, v := range values {
+		if oldest.IsZero() || v.Created.Before(oldest) {
+			oldest = v.Created
+		}
+	}
+	return oldest
+}
+
+// untilExpired returns how long until a value created at oldest is removed by the cleaner.
+// It returns 0 if it isn't known because the cleaner is disabled.
+func (tt *TempTxt) untilExpired(oldest time.Time) time.Duration {
+	if tt.cleanInterval == 0 || oldest.IsZero() {
+		return 0
+	}
+	return time.Until(oldest.Add(tt.maxAge)) + tt.cleanInterval
+}
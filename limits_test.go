@@ -0,0 +1,193 @@
+package temptxt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newLimitsTempTxt(t *testing.T) (*TempTxt, *Record) {
+	t.Helper()
+	tt := newTestTempTxt(t, recordDef{FQDN: "_acme-challenge.test1.example.com", Alias: "test1.example.com", Allowed: []string{"user[12]"}})
+	tt.cleanInterval = time.Minute
+	return tt, tt.records["_acme-challenge.test1.example.com."]
+}
+
+// assertRetryAfter checks that resp is a 429 with a Retry-After between 1 and max seconds.
+// A max of 0 expects no Retry-After.
+func assertRetryAfter(t *testing.T, resp *http.Response, max int) {
+	t.Helper()
+	assertStatus(http.StatusTooManyRequests, resp, t)
+	if max == 0 {
+		if v := resp.Header.Get("Retry-After"); v != "" {
+			t.Errorf("Expected no Retry-After, got %q", v)
+		}
+		return
+	}
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || s < 1 || s > max {
+		t.Errorf("Expected Retry-After between 1 and %d, got %q", max, resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestMaxValues(t *testing.T) {
+	tt, r := newLimitsTempTxt(t)
+	tt.maxValues = 2
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	for _, c := range []string{"a", "b"} {
+		resp := sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "test1.example.com", "content": "`+c+`"}`, "user1")
+		resp.Body.Close()
+		assertStatus(http.StatusNoContent, resp, t)
+	}
+
+	resp := sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "test1.example.com", "content": "c"}`, "user1")
+	resp.Body.Close()
+	assertRetryAfter(t, resp, 120)
+
+	resp = sendRequest(t, "POST", s.URL+"/present", `{"fqdn": "_acme-challenge.test1.example.com.", "value": "c"}`, "user1")
+	resp.Body.Close()
+	assertRetryAfter(t, resp, 120)
+
+	if values := valuesOf(t, r); !reflect.DeepEqual(values, []string{"a", "b"}) {
+		t.Errorf("Expected values %v, got %v", []string{"a", "b"}, values)
+	}
+
+	// Values can be added again once one is removed
+	resp = sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "test1.example.com", "content": "a", "action": "remove"}`, "user1")
+	resp.Body.Close()
+	resp = sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "test1.example.com", "content": "c"}`, "user1")
+	resp.Body.Close()
+	assertStatus(http.StatusNoContent, resp, t)
+}
+
+func TestMaxBytes(t *testing.T) {
+	tt, r := newLimitsTempTxt(t)
+	tt.maxBytes = 5
+	other := &Record{fqdn: "_acme-challenge.test2.example.com.", store: tt.store}
+	tt.records[other.fqdn] = other
+	if err := other.add(Value{Txt: "abc"}, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	resp := sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "test1.example.com", "content": "de"}`, "user1")
+	resp.Body.Close()
+	assertStatus(http.StatusNoContent, resp, t)
+
+	resp = sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "test1.example.com", "content": "f"}`, "user1")
+	resp.Body.Close()
+	assertRetryAfter(t, resp, 120)
+
+	if values := valuesOf(t, r); !reflect.DeepEqual(values, []string{"de"}) {
+		t.Errorf("Expected values %v, got %v", []string{"de"}, values)
+	}
+}
+
+// Values added at the same time shouldn't exceed max_bytes together.
+func TestMaxBytesConcurrent(t *testing.T) {
+	tt, r := newLimitsTempTxt(t)
+	tt.maxBytes = 5
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tt.addValue(r, Value{Txt: "a"})
+		}()
+	}
+	wg.Wait()
+
+	if values := valuesOf(t, r); len(values) != 5 {
+		t.Errorf("Expected 5 values, got %d", len(values))
+	}
+}
+
+// Without the cleaner, values don't expire so there is no Retry-After.
+func TestLimitNoClean(t *testing.T) {
+	tt, _ := newLimitsTempTxt(t)
+	tt.cleanInterval = 0
+	tt.maxValues = 1
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	for _, want := range []int{http.StatusNoContent, http.StatusTooManyRequests} {
+		resp := sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "test1.example.com", "content": "a"}`, "user1")
+		resp.Body.Close()
+		assertStatus(want, resp, t)
+		if want == http.StatusTooManyRequests {
+			assertRetryAfter(t, resp, 0)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	tt, _ := newLimitsTempTxt(t)
+	tt.rateLimit = newRateLimiter(2)
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	for i := 0; i < 2; i++ {
+		resp := sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "test1.example.com", "content": "a"}`, "user1")
+		resp.Body.Close()
+		assertStatus(http.StatusNoContent, resp, t)
+	}
+	resp := sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "test1.example.com", "content": "a"}`, "user1")
+	resp.Body.Close()
+	assertRetryAfter(t, resp, 60)
+
+	// Other users have their own limit
+	resp = sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "test1.example.com"}`, "user2")
+	resp.Body.Close()
+	assertStatus(http.StatusNoContent, resp, t)
+}
+
+func TestRateLimiterWindow(t *testing.T) {
+	rl := newRateLimiter(1)
+	if ok, _ := rl.allow("user1"); !ok {
+		t.Fatalf("Expected the first request to be allowed")
+	}
+	if ok, retryAfter := rl.allow("user1"); ok || retryAfter <= 0 || retryAfter > rateWindow {
+		t.Fatalf("Expected the second request to be limited, got %v, %v", ok, retryAfter)
+	}
+
+	// Start the next window
+	rl.windows["user1"].start = time.Now().Add(-rateWindow)
+	rl.windows["user2"] = &userWindow{start: time.Now().Add(-2 * rateWindow), requests: 1}
+	if ok, _ := rl.allow("user1"); !ok {
+		t.Errorf("Expected a request in the next window to be allowed")
+	}
+	if _, ok := rl.windows["user2"]; ok {
+		t.Errorf("Expected old windows to be removed")
+	}
+}
+
+func TestAcmeDNSLimits(t *testing.T) {
+	tt := newAcmeDNSTempTxt(t)
+	tt.cleanInterval = time.Minute
+	tt.rateLimit = newRateLimiter(2)
+	tt.maxBytes = 6
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	resp, account := acmeDNSRegister(t, s.URL, "admin")
+	assertStatus(http.StatusCreated, resp, t)
+
+	resp = acmeDNSUpdate(t, s.URL, account.Username, account.Password, account.Subdomain, "value1")
+	resp.Body.Close()
+	assertStatus(http.StatusOK, resp, t)
+
+	resp = acmeDNSUpdate(t, s.URL, account.Username, account.Password, account.Subdomain, "value2")
+	resp.Body.Close()
+	assertRetryAfter(t, resp, int((defaultMaxAge + time.Minute).Seconds()))
+
+	resp = acmeDNSUpdate(t, s.URL, account.Username, account.Password, account.Subdomain, "value3")
+	resp.Body.Close()
+	assertRetryAfter(t, resp, 60)
+}
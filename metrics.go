@@ -0,0 +1,47 @@
+package temptxt
+
+import (
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Values for the result label of queryCount.
+const (
+	resultAnswered = "answered"
+	resultNext     = "next"
+	resultNoData   = "nodata"
+)
+
+var (
+	// queryCount is the number of TXT queries for records, by whether they were answered,
+	// passed to the next plugin or answered with NODATA.
+	queryCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "temptxt",
+		Name:      "queries_total",
+		Help:      "Counter of TXT queries for records by result.",
+	}, []string{"server", "fqdn", "result"})
+	// updateCount is the number of requests to the update API by status code.
+	updateCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "temptxt",
+		Name:      "updates_total",
+		Help:      "Counter of update API requests by status code.",
+	}, []string{"code"})
+	// recordValues is the number of values currently held by each record.
+	recordValues = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "temptxt",
+		Name:      "values",
+		Help:      "The number of values currently held by a record.",
+	}, []string{"fqdn"})
+	// cleanedCount is the number of values removed by the cleaner.
+	cleanedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "temptxt",
+		Name:      "cleaned_values_total",
+		Help:      "Counter of values removed by the cleaner.",
+	}, []string{"fqdn"})
+)
@@ -0,0 +1,102 @@
+package temptxt
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	const fqdn = "_acme-challenge.metrics.example.com."
+	tt := newTestTempTxt(t, recordDef{FQDN: fqdn, Alias: "metrics.example.com", Allowed: []string{"user1"}})
+	tt.Next = testHandler()
+	tt.cleanInterval = 10 * time.Millisecond
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	query := func() {
+		req := new(dns.Msg)
+		req.SetQuestion(fqdn, dns.TypeTXT)
+		if _, err := tt.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), req); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	update := func(user string) {
+		req, err := http.NewRequest("PUT", s.URL+"/update", bytes.NewBufferString(`{"fqdn": "metrics.example.com.", "content": "a"}`))
+		if err != nil {
+			t.Fatalf("Error creating request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if user != "" {
+			req.Header.Set("X-Forwarded-User", user)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	// The counters are shared by all tests, so only the changes are checked
+	next := testutil.ToFloat64(queryCount.WithLabelValues("", fqdn, resultNext))
+	answered := testutil.ToFloat64(queryCount.WithLabelValues("", fqdn, resultAnswered))
+	cleaned := testutil.ToFloat64(cleanedCount.WithLabelValues(fqdn))
+	noContent := testutil.ToFloat64(updateCount.WithLabelValues("204"))
+	unauthorized := testutil.ToFloat64(updateCount.WithLabelValues("401"))
+	forbidden := testutil.ToFloat64(updateCount.WithLabelValues("403"))
+
+	query()
+	update("")
+	update("user2")
+	update("user1")
+	query()
+
+	if v := testutil.ToFloat64(queryCount.WithLabelValues("", fqdn, resultNext)) - next; v != 1 {
+		t.Errorf("Expected 1 query passed to next, got %v", v)
+	}
+	if v := testutil.ToFloat64(queryCount.WithLabelValues("", fqdn, resultAnswered)) - answered; v != 1 {
+		t.Errorf("Expected 1 query answered, got %v", v)
+	}
+	if v := testutil.ToFloat64(updateCount.WithLabelValues("204")) - noContent; v != 1 {
+		t.Errorf("Expected 1 update with 204, got %v", v)
+	}
+	if v := testutil.ToFloat64(updateCount.WithLabelValues("401")) - unauthorized; v != 1 {
+		t.Errorf("Expected 1 update with 401, got %v", v)
+	}
+	if v := testutil.ToFloat64(updateCount.WithLabelValues("403")) - forbidden; v != 1 {
+		t.Errorf("Expected 1 update with 403, got %v", v)
+	}
+	// recordValues is set to the current number of values
+	if v := testutil.ToFloat64(recordValues.WithLabelValues(fqdn)); v != 1 {
+		t.Errorf("Expected 1 value, got %v", v)
+	}
+
+	// Expire the value
+	_, err := tt.store.Update(fqdn, func(s RecordState) RecordState {
+		s.Values[0].Created = time.Now().Add(-2 * time.Minute)
+		return s
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tt.Run(ctx)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	if v := testutil.ToFloat64(cleanedCount.WithLabelValues(fqdn)) - cleaned; v != 1 {
+		t.Errorf("Expected 1 cleaned value, got %v", v)
+	}
+	if v := testutil.ToFloat64(recordValues.WithLabelValues(fqdn)); v != 0 {
+		t.Errorf("Expected 0 values, got %v", v)
+	}
+}
@@ -0,0 +1,192 @@
+package temptxt
+
+import (
+	"regexp"
+	"strings"
+)
+
+// pattern creates records on demand for names where one label is a wildcard
+// (eg. *.apps.example.com).
+type pattern struct {
+	// prefix is added to the name to get the FQDN the record is served at.
+	prefix string
+	// head and tail are the parts of the name before and after the wildcard label.
+	head string
+	tail string
+	// allowed are the users that can create and update records.
+	// If a regexp has a capture group, the first group must match the wildcard label.
+	allowed []*regexp.Regexp
+}
+
+// newPattern returns a pattern for name or nil if name doesn't contain
+// a wildcard label.
+func newPattern(prefix string, name string) *pattern {
+	var p *pattern
+	if strings.HasPrefix(name, "*.") {
+		p = &pattern{prefix: prefix, tail: name[1:]}
+	} else if i := strings.Index(name, ".*."); i != -1 {
+		p = &pattern{prefix: prefix, head: name[:i+1], tail: name[i+2:]}
+	}
+	return p
+}
+
+// label returns the label matched by the wildcard in name.
+func (p *pattern) label(name string) (string, bool) {
+	if len(name) <= len(p.head)+len(p.tail) || !strings.HasPrefix(name, p.head) || !strings.HasSuffix(name, p.tail) {
+		return "", false
+	}
+	l := name[len(p.head) : len(name)-len(p.tail)]
+	if strings.Contains(l, ".") {
+		return "", false
+	}
+	return l, true
+}
+
+// newRecord returns a new record for the wildcard label l.
+func (p *pattern) newRecord(l string) (string, *Record) {
+	name := p.head + l + p.tail
+	return name, &Record{fqdn: p.prefix + name, allowed: p.allowed, label: l, pattern: p}
+}
+
+// matchUser returns true if re matches user. If label is set and re has a
+// capture group, the first group must also be equal to label.
+func matchUser(re *regexp.Regexp, user string, label string) bool {
+	if label == "" || re.NumSubexp() == 0 {
+		return re.MatchString(user)
+	}
+	m := re.FindStringSubmatch(user)
+	return m != nil && strings.EqualFold(m[1], label)
+}
+
+// matchPattern returns the first pattern matching the name used in
+// API requests and the wildcard label.
+func (tt *TempTxt) matchPattern(name string) (*pattern, string) {
+	name = strings.ToLower(name)
+	tt.mtx.RLock()
+	defer tt.mtx.RUnlock()
+	for _, p := range tt.patterns {
+		if l, ok := p.label(name); ok {
+			return p, l
+		}
+	}
+	return nil, ""
+}
+
+// matchPatternFQDN is like matchPattern but for the FQDN the record is served at.
+func (tt *TempTxt) matchPatternFQDN(fqdn string) (*pattern, string) {
+	tt.mtx.RLock()
+	defer tt.mtx.RUnlock()
+	return tt.matchPatternFQDNLocked(fqdn)
+}
+
+// matchPatternFQDNLocked is like matchPatternFQDN but the caller must hold tt.mtx.
+func (tt *TempTxt) matchPatternFQDNLocked(fqdn string) (*pattern, string) {
+	for _, p := range tt.patterns {
+		if !strings.HasPrefix(fqdn, p.prefix) {
+			continue
+		}
+		if l, ok := p.label(fqdn[len(p.prefix):]); ok {
+			return p, l
+		}
+	}
+	return nil, ""
+}
+
+// patternRecord returns the record for the wildcard label l of p.
+// The record is only added if user is authorized to update it,
+// otherwise it is returned without being added so the caller can reject the request.
+func (tt *TempTxt) patternRecord(p *pattern, l string, user string) *Record {
+	name, r := p.newRecord(l)
+	if !r.IsAuthorized(user) {
+		return r
+	}
+
+	tt.mtx.Lock()
+	defer tt.mtx.Unlock()
+	return tt.addPatternRecordLocked(name, r)
+}
+
+// addPatternRecordLocked adds r as name unless a record already exists.
+// The caller must hold tt.mtx.
+func (tt *TempTxt) addPatternRecordLocked(name string, r *Record) *Record {
+	if existing, ok := tt.aliases[name]; ok {
+		return existing
+	}
+	if existing, ok := tt.records[r.fqdn]; ok {
+		return existing
+	}
+	log.Infof("Creating record %q from pattern", r.fqdn)
+	r.store = tt.store
+	tt.records[r.fqdn] = r
+	tt.aliases[name] = r
+	return r
+}
+
+// servedRecord returns the record served at fqdn. If there is none but fqdn
+// matches a pattern and has values in the store, the record is created.
+// This finds records created from a pattern by other instances sharing the store.
+func (tt *TempTxt) servedRecord(fqdn string) (*Record, bool) {
+	if r, ok := tt.getRecord(fqdn); ok {
+		return r, true
+	}
+	p, l := tt.matchPatternFQDN(fqdn)
+	if p == nil {
+		return nil, false
+	}
+	s, err := tt.store.Get(fqdn)
+	if err != nil {
+		log.Errorf("Error getting values of %q: %v", fqdn, err)
+		return nil, false
+	}
+	if len(s.Values) == 0 {
+		return nil, false
+	}
+
+	tt.mtx.Lock()
+	defer tt.mtx.Unlock()
+	return tt.addPatternRecordLocked(p.newRecord(l)), true
+}
+
+// aliasOrPattern returns the record for the name used in API requests.
+// If there is none, a record is created from a matching pattern.
+func (tt *TempTxt) aliasOrPattern(name string, user string) *Record {
+	if r, ok := tt.getAlias(name); ok {
+		return r
+	}
+	if p, l := tt.matchPattern(name); p != nil {
+		return tt.patternRecord(p, l, user)
+	}
+	return nil
+}
+
+// lookupRecord is like recordOrPattern but a record from a pattern is returned
+// without being added. name is then the name to add it as with addPatternRecord,
+// and is empty for records that already exist.
+func (tt *TempTxt) lookupRecord(fqdn string) (*Record, string) {
+	if r, ok := tt.getRecord(fqdn); ok {
+		return r, ""
+	}
+	if p, l := tt.matchPatternFQDN(fqdn); p != nil {
+		name, r := p.newRecord(l)
+		return r, name
+	}
+	return nil, ""
+}
+
+// addPatternRecord adds r from lookupRecord as name unless a record already exists.
+func (tt *TempTxt) addPatternRecord(name string, r *Record) *Record {
+	tt.mtx.Lock()
+	defer tt.mtx.Unlock()
+	return tt.addPatternRecordLocked(name, r)
+}
+
+// recordOrPattern is like aliasOrPattern but for the FQDN the record is served at.
+func (tt *TempTxt) recordOrPattern(fqdn string, user string) *Record {
+	if r, ok := tt.getRecord(fqdn); ok {
+		return r
+	}
+	if p, l := tt.matchPatternFQDN(fqdn); p != nil {
+		return tt.patternRecord(p, l, user)
+	}
+	return nil
+}
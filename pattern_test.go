@@ -0,0 +1,153 @@
+package temptxt
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestPatternLabel(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    string
+		wantOk  bool
+	}{
+		{pattern: "*.apps.example.com.", name: "web01.apps.example.com.", want: "web01", wantOk: true},
+		{pattern: "*.apps.example.com.", name: "a.web01.apps.example.com.", wantOk: false},
+		{pattern: "*.apps.example.com.", name: ".apps.example.com.", wantOk: false},
+		{pattern: "*.apps.example.com.", name: "apps.example.com.", wantOk: false},
+		{pattern: "*.apps.example.com.", name: "web01.example.com.", wantOk: false},
+		{pattern: "_acme-challenge.*.example.com.", name: "_acme-challenge.web01.example.com.", want: "web01", wantOk: true},
+		{pattern: "_acme-challenge.*.example.com.", name: "web01.example.com.", wantOk: false},
+	}
+
+	for i, tc := range tests {
+		p := newPattern("", tc.pattern)
+		have, ok := p.label(tc.name)
+		if ok != tc.wantOk || have != tc.want {
+			t.Errorf("[%d] Expected (%q, %t), got (%q, %t)", i, tc.want, tc.wantOk, have, ok)
+		}
+	}
+}
+
+func TestMatchUser(t *testing.T) {
+	tests := []struct {
+		re    string
+		user  string
+		label string
+		want  bool
+	}{
+		{re: "^user-(.*)$", user: "user-web01", label: "web01", want: true},
+		{re: "^user-(.*)$", user: "user-WEB01", label: "web01", want: true},
+		{re: "^user-(.*)$", user: "user-web02", label: "web01", want: false},
+		{re: "^admin$", user: "admin", label: "web01", want: true},
+		// Captures are ignored for records that are not from a pattern.
+		{re: "^user-(.*)$", user: "user-web02", label: "", want: true},
+	}
+
+	for i, tc := range tests {
+		if have := matchUser(regexp.MustCompile(tc.re), tc.user, tc.label); have != tc.want {
+			t.Errorf("[%d] Expected %t, got %t", i, tc.want, have)
+		}
+	}
+}
+
+func newPatternTempTxt(t *testing.T, persistPath string) *TempTxt {
+	t.Helper()
+	cfg := `temptxt _acme-challenge. {
+	txt *.apps.example.com user-(.*) admin
+	txt static.apps.example.com static
+}`
+	if persistPath != "" {
+		cfg = `temptxt _acme-challenge. {
+	txt *.apps.example.com user-(.*) admin
+	persist ` + persistPath + `
+}`
+	}
+	tt, err := parseConfig(caddy.NewTestController("dns", cfg))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tt.Next = testHandler()
+	return tt
+}
+
+func TestPatternUpdate(t *testing.T) {
+	tt := newPatternTempTxt(t, "")
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	tests := []struct {
+		fqdn string
+		user string
+		want int
+	}{
+		{fqdn: "web01.apps.example.com", user: "user-web02", want: http.StatusForbidden},
+		{fqdn: "web01.apps.example.com", user: "user-web01", want: http.StatusNoContent},
+		{fqdn: "web02.apps.example.com", user: "admin", want: http.StatusNoContent},
+		{fqdn: "a.web01.apps.example.com", user: "user-web01", want: http.StatusNotFound},
+		// Static records take precedence over patterns
+		{fqdn: "static.apps.example.com", user: "user-static", want: http.StatusForbidden},
+		{fqdn: "static.apps.example.com", user: "static", want: http.StatusNoContent},
+	}
+
+	for i, tc := range tests {
+		resp := sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "`+tc.fqdn+`", "content": "`+tc.user+`"}`, tc.user)
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("[%d] Expected status code %d, got %d", i, tc.want, resp.StatusCode)
+		}
+	}
+
+	// Unauthorized requests must not create records.
+	tt.mtx.RLock()
+	n := len(tt.records)
+	tt.mtx.RUnlock()
+	if n != 3 {
+		t.Errorf("Expected 3 records, got %d", n)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("_acme-challenge.web01.apps.example.com.", dns.TypeTXT)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := tt.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].(*dns.TXT).Txt[0] != "user-web01" {
+		t.Errorf("Unexpected answer %v", rec.Msg.Answer)
+	}
+}
+
+func TestPatternPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	tt := newPatternTempTxt(t, path)
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	resp := sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "web01.apps.example.com", "content": "a"}`, "user-web01")
+	resp.Body.Close()
+	assertStatus(http.StatusNoContent, resp, t)
+
+	tt2 := newPatternTempTxt(t, path)
+	r, ok := tt2.getAlias("web01.apps.example.com.")
+	if !ok {
+		t.Fatalf("Expected the record to be restored")
+	}
+	if want := []string{"a"}; !reflect.DeepEqual(valuesOf(t, r), want) {
+		t.Errorf("Expected content %v, got %v", want, valuesOf(t, r))
+	}
+	if !r.IsAuthorized("user-web01") || r.IsAuthorized("user-web02") {
+		t.Errorf("Expected the restored record to only allow user-web01")
+	}
+}
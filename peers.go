@@ -0,0 +1,261 @@
+package temptxt
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPeerSync = 30 * time.Second
+	// peerSignatureHeader is the hex encoded HMAC-SHA256 of the body.
+	peerSignatureHeader = "X-Temptxt-Signature"
+	// peerMaxBody is the maximum size of a message from a peer.
+	peerMaxBody = 10 << 20
+)
+
+// peers replicates the content of the records between temptxt instances.
+//
+// Every change is sent to all peers and the full state is exchanged every sync
+// interval so that peers converge after being unreachable. The most recently
+// updated version of a record wins. Expired values are removed by every peer
+// on its own as the creation times are replicated.
+type peers struct {
+	urls   []string
+	secret []byte
+	sync   time.Duration
+	client *http.Client
+}
+
+// peerMessage is sent between peers.
+type peerMessage struct {
+	Records map[string]RecordState `json:"records"`
+	// Full is set when the sender wants the full state of the receiver in the response.
+	Full bool `json:"full,omitempty"`
+}
+
+// sign returns the signature of body.
+func (p *peers) sign(body []byte) string {
+	return sign(p.secret, body)
+}
+
+// sign returns the hex encoded HMAC-SHA256 of body.
+func sign(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns true if signature is the signature of body.
+func (p *peers) verify(body []byte, signature string) bool {
+	want, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+// recordStates returns the state of records. If records is empty,
+// the state of every record that has been updated is returned.
+func (tt *TempTxt) recordStates(records ...*Record) map[string]RecordState {
+	byName := make(map[string]*Record, len(records))
+	for _, r := range records {
+		byName[r.fqdn] = r
+	}
+	if len(records) == 0 {
+		tt.mtx.RLock()
+		for name, r := range tt.records {
+			byName[name] = r
+		}
+		tt.mtx.RUnlock()
+	}
+
+	states := make(map[string]RecordState, len(byName))
+	for name, r := range byName {
+		s, err := r.state()
+		if err != nil {
+			log.Errorf("Error getting values of %q: %v", name, err)
+			continue
+		}
+		if !s.Updated.IsZero() {
+			if s.Values == nil {
+				s.Values = []Value{}
+			}
+			states[name] = s
+		}
+	}
+	return states
+}
+
+// mergeRecords applies the records that were updated more recently than ours.
+// It returns true if anything changed.
+func (tt *TempTxt) mergeRecords(states map[string]RecordState) bool {
+	changed := false
+	for fqdn, rs := range states {
+		r, ok := tt.getRecord(fqdn)
+		if !ok {
+			// The record may have been created from a pattern by the peer
+			p, l := tt.matchPatternFQDN(fqdn)
+			if p == nil {
+				continue
+			}
+			tt.mtx.Lock()
+			r = tt.addPatternRecordLocked(p.newRecord(l))
+			tt.mtx.Unlock()
+		}
+
+		newer := false
+		_, err := r.update(func(s RecordState) RecordState {
+			newer = rs.Updated.After(s.Updated)
+			if newer {
+				return rs
+			}
+			return s
+		})
+		if err != nil {
+			log.Errorf("Error updating %q: %v", fqdn, err)
+			continue
+		}
+		changed = changed || newer
+	}
+	if changed {
+		tt.setModified()
+	}
+	return changed
+}
+
+// replicate sends the state of records to every peer in the background.
+func (tt *TempTxt) replicate(records ...*Record) {
+	if tt.peers == nil || len(records) == 0 {
+		return
+	}
+	msg := peerMessage{Records: tt.recordStates(records...)}
+	for _, u := range tt.peers.urls {
+		go func(u string) {
+			if err := tt.sendToPeer(context.Background(), u, msg); err != nil {
+				log.Errorf("Error replicating to peer %q: %v", u, err)
+			}
+		}(u)
+	}
+}
+
+// syncPeers exchanges the full state with every peer.
+func (tt *TempTxt) syncPeers(ctx context.Context) {
+	msg := peerMessage{Records: tt.recordStates(), Full: true}
+	for _, u := range tt.peers.urls {
+		if err := tt.sendToPeer(ctx, u, msg); err != nil {
+			log.Errorf("Error syncing with peer %q: %v", u, err)
+		}
+	}
+}
+
+// sendToPeer sends msg to the peer at url. If msg.Full is set,
+// the state of the peer in the response is merged.
+func (tt *TempTxt) sendToPeer(ctx context.Context, url string, msg peerMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(url, "/")+"/peer/sync", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(peerSignatureHeader, tt.peers.sign(body))
+
+	resp, err := tt.peers.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if !msg.Full {
+		return nil
+	}
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, peerMaxBody))
+	if err != nil {
+		return err
+	}
+	if !tt.peers.verify(respBody, resp.Header.Get(peerSignatureHeader)) {
+		return fmt.Errorf("invalid signature in response")
+	}
+	state := peerMessage{}
+	if err := json.Unmarshal(respBody, &state); err != nil {
+		return err
+	}
+	tt.mergeRecords(state.Records)
+	return nil
+}
+
+// peerHandler receives the state of records from peers.
+func (tt *TempTxt) peerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, peerMaxBody))
+	if err != nil {
+		http.Error(w, "error reading body", http.StatusBadRequest)
+		return
+	}
+	// Replayed messages are harmless since older versions of records are ignored.
+	if !tt.peers.verify(body, r.Header.Get(peerSignatureHeader)) {
+		log.Errorf("Invalid peer signature from %s", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	msg := peerMessage{}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		http.Error(w, "error parsing body", http.StatusBadRequest)
+		return
+	}
+
+	tt.mergeRecords(msg.Records)
+
+	if !msg.Full {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	respBody, err := json.Marshal(peerMessage{Records: tt.recordStates()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(peerSignatureHeader, tt.peers.sign(respBody))
+	if _, err := w.Write(respBody); err != nil {
+		log.Errorf("Error writing state to peer: %v", err)
+	}
+}
+
+// runPeers periodically syncs the full state with the peers.
+func (tt *TempTxt) runPeers(ctx context.Context) {
+	go func() {
+		tt.syncPeers(ctx)
+		ticker := time.NewTicker(tt.peers.sync)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				tt.syncPeers(ctx)
+			}
+		}
+	}()
+}
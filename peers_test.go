@@ -0,0 +1,186 @@
+package temptxt
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newPeerTempTxt(t *testing.T) *TempTxt {
+	t.Helper()
+	tt := newTestTempTxt(t, recordDef{FQDN: "test.example.com", Allowed: []string{"user1"}})
+	tt.maxAge = defaultMaxAge
+	tt.peers = &peers{
+		secret: []byte("secret"),
+		sync:   defaultPeerSync,
+		client: &http.Client{Timeout: time.Second},
+	}
+	return tt
+}
+
+// newPeerPair returns two instances that are peers of each other.
+func newPeerPair(t *testing.T) (*TempTxt, *httptest.Server, *TempTxt, *httptest.Server) {
+	t.Helper()
+	a, b := newPeerTempTxt(t), newPeerTempTxt(t)
+	sa, sb := httptest.NewServer(a.handler()), httptest.NewServer(b.handler())
+	t.Cleanup(sa.Close)
+	t.Cleanup(sb.Close)
+	a.peers.urls = []string{sb.URL}
+	b.peers.urls = []string{sa.URL}
+	return a, sa, b, sb
+}
+
+// waitForValues waits until the record of tt has the values.
+func waitForValues(t *testing.T, tt *TempTxt, want []string) {
+	t.Helper()
+	r := tt.records["test.example.com."]
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if reflect.DeepEqual(valuesOf(t, r), want) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Expected content %v, got %v", want, valuesOf(t, r))
+}
+
+func TestPeerSignature(t *testing.T) {
+	p := &peers{secret: []byte("secret")}
+	sig := p.sign([]byte("body"))
+	if !p.verify([]byte("body"), sig) {
+		t.Errorf("Expected the signature to be valid")
+	}
+	if p.verify([]byte("other"), sig) {
+		t.Errorf("Expected the signature to be invalid for another body")
+	}
+	if p.verify([]byte("body"), "invalid") {
+		t.Errorf("Expected an invalid signature to be rejected")
+	}
+	other := &peers{secret: []byte("other")}
+	if other.verify([]byte("body"), sig) {
+		t.Errorf("Expected the signature to be invalid with another secret")
+	}
+}
+
+func TestPeerReplication(t *testing.T) {
+	a, sa, b, _ := newPeerPair(t)
+
+	resp := sendRequest(t, "PUT", sa.URL+"/update", `{"fqdn": "test.example.com", "content": "a"}`, "user1")
+	resp.Body.Close()
+	assertStatus(http.StatusNoContent, resp, t)
+	waitForValues(t, b, []string{"a"})
+
+	resp = sendRequest(t, "PUT", sa.URL+"/update", `{"fqdn": "test.example.com", "content": "a", "action": "remove"}`, "user1")
+	resp.Body.Close()
+	assertStatus(http.StatusNoContent, resp, t)
+	waitForValues(t, b, []string{})
+
+	as, _ := a.records["test.example.com."].state()
+	bs, _ := b.records["test.example.com."].state()
+	if have, want := bs.Updated, as.Updated; !have.Equal(want) {
+		t.Errorf("Expected updated %v, got %v", want, have)
+	}
+}
+
+// Peers should converge once they can reach each other again.
+func TestPeerSync(t *testing.T) {
+	a, _, b, _ := newPeerPair(t)
+
+	// Partition
+	urls := a.peers.urls
+	a.peers.urls, b.peers.urls = nil, nil
+
+	if err := a.records["test.example.com."].add(Value{Txt: "old"}, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	if err := b.records["test.example.com."].add(Value{Txt: "new"}, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	a.peers.urls = urls
+	a.syncPeers(context.Background())
+
+	// b was updated last so it wins on both
+	for _, tt := range []*TempTxt{a, b} {
+		if want := []string{"new"}; !reflect.DeepEqual(valuesOf(t, tt.records["test.example.com."]), want) {
+			t.Errorf("Expected content %v, got %v", want, valuesOf(t, tt.records["test.example.com."]))
+		}
+	}
+}
+
+// Older versions of a record should be ignored.
+func TestPeerMergeOlder(t *testing.T) {
+	tt := newPeerTempTxt(t)
+	if err := tt.records["test.example.com."].add(Value{Txt: "new"}, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	changed := tt.mergeRecords(map[string]RecordState{
+		"test.example.com.":    {Values: []Value{{Txt: "old", Created: time.Now().Add(-time.Minute)}}, Updated: time.Now().Add(-time.Minute)},
+		"unknown.example.com.": {Values: []Value{{Txt: "a", Created: time.Now()}}, Updated: time.Now()},
+	})
+	if changed {
+		t.Errorf("Expected nothing to change")
+	}
+	if want := []string{"new"}; !reflect.DeepEqual(valuesOf(t, tt.records["test.example.com."]), want) {
+		t.Errorf("Expected content %v, got %v", want, valuesOf(t, tt.records["test.example.com."]))
+	}
+	if _, ok := tt.records["unknown.example.com."]; ok {
+		t.Errorf("Expected unknown records to be ignored")
+	}
+}
+
+func TestPeerHandlerErrors(t *testing.T) {
+	tt := newPeerTempTxt(t)
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	body := []byte(`{"records": {}}`)
+	tests := []struct {
+		method    string
+		body      []byte
+		signature string
+		want      int
+	}{
+		{method: "GET", want: http.StatusMethodNotAllowed},
+		{method: "POST", body: body, signature: "", want: http.StatusUnauthorized},
+		{method: "POST", body: body, signature: (&peers{secret: []byte("other")}).sign(body), want: http.StatusUnauthorized},
+		{method: "POST", body: []byte("invalid"), signature: tt.peers.sign([]byte("invalid")), want: http.StatusBadRequest},
+		{method: "POST", body: body, signature: tt.peers.sign(body), want: http.StatusNoContent},
+	}
+
+	for i, tc := range tests {
+		req, err := http.NewRequest(tc.method, s.URL+"/peer/sync", bytes.NewReader(tc.body))
+		if err != nil {
+			t.Fatalf("Error creating request: %v", err)
+		}
+		req.Header.Set(peerSignatureHeader, tc.signature)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("[%d] Expected status code %d, got %d", i, tc.want, resp.StatusCode)
+		}
+	}
+}
+
+func TestPeerConfig(t *testing.T) {
+	tt := getConfig(`temptxt {
+	peers http://192.0.2.1:8080 https://192.0.2.2:8443
+	peer_secret secret
+	peer_sync 1m
+}`, t)
+	if want := []string{"http://192.0.2.1:8080", "https://192.0.2.2:8443"}; !reflect.DeepEqual(tt.peers.urls, want) {
+		t.Errorf("Expected %v, got %v", want, tt.peers.urls)
+	}
+	if tt.peers.sync != time.Minute {
+		t.Errorf("Expected %v, got %v", time.Minute, tt.peers.sync)
+	}
+}
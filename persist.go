@@ -0,0 +1,206 @@
+package temptxt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// persistedState is the on-disk representation of the plugin's state.
+type persistedState struct {
+	Records map[string]RecordState `json:"records"`
+	// Accounts are the accounts registered through the acme-dns API.
+	Accounts map[string]*acmeDNSAccount `json:"accounts,omitempty"`
+}
+
+// accountStore is implemented by stores that also keep the acme-dns accounts.
+type accountStore interface {
+	// accounts returns the saved accounts.
+	accounts() map[string]*acmeDNSAccount
+	// saveAccounts replaces the saved accounts.
+	saveAccounts(accounts map[string]*acmeDNSAccount) error
+}
+
+// fileStore is a memoryStore that is saved to a file after every update.
+// The file is replaced atomically so a crash never leaves a partial file.
+type fileStore struct {
+	memoryStore
+	path  string
+	accts map[string]*acmeDNSAccount
+}
+
+func newFileStoreFactory(args []string, opts StoreOptions) (Store, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("file store takes exactly one argument")
+	}
+	return newFileStore(args[0], opts.MaxAge)
+}
+
+// newFileStore returns a store saved to path. Any state already in path is loaded
+// except for values older than maxAge.
+func newFileStore(path string, maxAge time.Duration) (*fileStore, error) {
+	s := &fileStore{memoryStore: memoryStore{states: make(map[string]RecordState)}, path: path}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	state := persistedState{}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+
+	s.accts = state.Accounts
+	for name, rs := range state.Records {
+		if values := expireValues(rs, maxAge); len(values) > 0 {
+			s.states[name] = RecordState{Values: values, Updated: rs.Updated}
+		}
+	}
+
+	return s, nil
+}
+
+// Update implements Store. The change is undone if the file can't be saved.
+func (s *fileStore) Update(fqdn string, fn func(RecordState) RecordState) (RecordState, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	old, existed := s.states[fqdn]
+	state := s.updateLocked(fqdn, fn)
+	if err := s.saveLocked(); err != nil {
+		if existed {
+			s.states[fqdn] = old
+		} else {
+			delete(s.states, fqdn)
+		}
+		return RecordState{}, err
+	}
+	return state, nil
+}
+
+func (s *fileStore) accounts() map[string]*acmeDNSAccount {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	accounts := make(map[string]*acmeDNSAccount, len(s.accts))
+	for username, account := range s.accts {
+		accounts[username] = account
+	}
+	return accounts
+}
+
+func (s *fileStore) saveAccounts(accounts map[string]*acmeDNSAccount) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	old := s.accts
+	s.accts = make(map[string]*acmeDNSAccount, len(accounts))
+	for username, account := range accounts {
+		s.accts[username] = account
+	}
+	if err := s.saveLocked(); err != nil {
+		s.accts = old
+		return err
+	}
+	return nil
+}
+
+// saveLocked writes the state to s.path. The caller must hold s.mtx.
+func (s *fileStore) saveLocked() error {
+	state := persistedState{Records: make(map[string]RecordState, len(s.states)), Accounts: s.accts}
+	for name, rs := range s.states {
+		if len(rs.Values) > 0 {
+			state.Records[name] = rs
+		}
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// saveAcmeDNSAccounts saves the acme-dns accounts if the store keeps them and logs any errors.
+func (tt *TempTxt) saveAcmeDNSAccounts() {
+	as, ok := tt.store.(accountStore)
+	if !ok {
+		return
+	}
+	tt.mtx.RLock()
+	err := as.saveAccounts(tt.acmeDNS.accounts)
+	tt.mtx.RUnlock()
+	if err != nil {
+		log.Errorf("Error saving acme-dns accounts: %v", err)
+	}
+}
+
+// loadAcmeDNSAccounts adds the acme-dns accounts kept by the store.
+func (tt *TempTxt) loadAcmeDNSAccounts() error {
+	as, ok := tt.store.(accountStore)
+	if !ok {
+		return nil
+	}
+	tt.mtx.Lock()
+	defer tt.mtx.Unlock()
+	for username, account := range as.accounts() {
+		if err := tt.addAcmeDNSAccount(username, account); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadStore creates the records for any names in the store that match a pattern
+// and sets the metrics of the records that have values.
+// Other names that aren't configured are ignored.
+func (tt *TempTxt) loadStore() error {
+	names, err := tt.store.Names()
+	if err != nil {
+		return err
+	}
+	tt.mtx.Lock()
+	records := make([]*Record, 0, len(names))
+	for _, name := range names {
+		r, ok := tt.records[name]
+		if !ok {
+			p, l := tt.matchPatternFQDNLocked(name)
+			if p == nil {
+				continue
+			}
+			r = tt.addPatternRecordLocked(p.newRecord(l))
+		}
+		records = append(records, r)
+	}
+	tt.mtx.Unlock()
+
+	for _, r := range records {
+		rs, err := r.state()
+		if err != nil {
+			return err
+		}
+		r.setValuesMetric(len(rs.Values))
+		// The values may need to be cleaned
+		tt.setModified()
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package temptxt
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// setStates sets the state of every record in states.
+func setStates(t *testing.T, s Store, states map[string]RecordState) {
+	t.Helper()
+	for name, state := range states {
+		state := state
+		if _, err := s.Update(name, func(RecordState) RecordState { return state }); err != nil {
+			t.Fatalf("Error updating %q: %v", name, err)
+		}
+	}
+}
+
+func TestFileStoreSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	updated := time.Now().Add(-time.Minute).Round(0)
+	src, err := newFileStore(path, 5*time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	setStates(t, src, map[string]RecordState{
+		"test1.example.com.": {Values: []Value{{Txt: "a", Created: updated}, {Txt: "b", Created: updated}}, Updated: updated},
+		"test2.example.com.": {Values: []Value{{Txt: "c", Created: updated}}, Updated: updated},
+		"test3.example.com.": {Updated: updated},
+	})
+
+	dst, err := newFileStore(path, 5*time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error loading: %v", err)
+	}
+
+	s, _ := dst.Get("test1.example.com.")
+	if want := []string{"a", "b"}; !reflect.DeepEqual(s.txts(), want) {
+		t.Errorf("Expected content %v, got %v", want, s.txts())
+	}
+	if !s.Updated.Equal(updated) {
+		t.Errorf("Expected updated %v, got %v", updated, s.Updated)
+	}
+	// Records without values aren't saved
+	if names, _ := dst.Names(); !reflect.DeepEqual(names, []string{"test1.example.com.", "test2.example.com."}) {
+		t.Errorf("Unexpected names %v", names)
+	}
+}
+
+func TestFileStoreLoadExpired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	src, err := newFileStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	setStates(t, src, map[string]RecordState{
+		"test1.example.com.": {Values: []Value{{Txt: "old", Created: time.Now().Add(-10 * time.Minute)}}, Updated: time.Now().Add(-10 * time.Minute)},
+	})
+
+	dst, err := newFileStore(path, 5*time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error loading: %v", err)
+	}
+	if names, _ := dst.Names(); len(names) != 0 {
+		t.Errorf("Expected no records, got %v", names)
+	}
+}
+
+func TestFileStoreLoadMissing(t *testing.T) {
+	if _, err := newFileStore(filepath.Join(t.TempDir(), "missing.json"), time.Minute); err != nil {
+		t.Errorf("Expected no error but got: %v", err)
+	}
+}
+
+func TestFileStoreLoadInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte("invalid"), 0o600); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	if _, err := newFileStore(path, time.Minute); err == nil {
+		t.Errorf("Expected error but got nil")
+	}
+}
+
+func TestFileStoreLoadPerValue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	src, err := newFileStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	setStates(t, src, map[string]RecordState{
+		"test1.example.com.": {
+			Values:  []Value{{Txt: "old", Created: time.Now().Add(-10 * time.Minute)}, {Txt: "new", Created: time.Now()}},
+			Updated: time.Now(),
+		},
+	})
+
+	dst, err := newFileStore(path, 5*time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error loading: %v", err)
+	}
+	if s, _ := dst.Get("test1.example.com."); !reflect.DeepEqual(s.txts(), []string{"new"}) {
+		t.Errorf("Expected content %v, got %v", []string{"new"}, s.txts())
+	}
+}
+
+func TestFileStoreUpdateError(t *testing.T) {
+	s, err := newFileStore(filepath.Join(t.TempDir(), "does-not-exist", "state.json"), time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	r := &Record{fqdn: "test1.example.com.", store: s}
+	if err := r.add(Value{Txt: "a"}, 0); err == nil {
+		t.Errorf("Expected an error saving the file")
+	}
+	if values, _ := r.values(); len(values) != 0 {
+		t.Errorf("Expected the update to be undone, got %v", values)
+	}
+}
@@ -0,0 +1,283 @@
+package temptxt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// recordDef is the definition of a record, the same as a txt or txt_alias line.
+type recordDef struct {
+	// FQDN is the FQDN for txt or ACTUAL_FQDN for txt_alias.
+	FQDN string `json:"fqdn" yaml:"fqdn"`
+	// Alias is UPDATE_FQDN for txt_alias.
+	Alias string `json:"alias,omitempty" yaml:"alias,omitempty"`
+	// Allowed are the regexps of the users that can update the record.
+	Allowed []string `json:"allowed" yaml:"allowed"`
+}
+
+// addRecordLocked adds the record for def.
+// The PREFIX and SUFFIX are added to the FQDN as they would be in the Corefile.
+// The caller must hold tt.mtx.
+func (tt *TempTxt) addRecordLocked(def recordDef) error {
+	if def.FQDN == "" {
+		return errors.New("fqdn cannot be empty")
+	}
+	if len(def.Allowed) == 0 {
+		return errors.New("at least one user regexp is required")
+	}
+	allowed := make([]*regexp.Regexp, 0, len(def.Allowed))
+	for _, u := range def.Allowed {
+		re, err := regexp.Compile("^" + u + "$")
+		if err != nil {
+			return fmt.Errorf("unable to compile regexp: %v", err)
+		}
+		allowed = append(allowed, re)
+	}
+
+	name := dns.Fqdn(strings.ToLower(def.FQDN))
+	if strings.Contains(name, "*") {
+		if def.Alias != "" {
+			return fmt.Errorf("wildcards are not supported for txt_alias %q", name)
+		}
+		p := newPattern(tt.prefix, name+tt.suffix)
+		if p == nil || strings.Count(name, "*") != 1 {
+			return fmt.Errorf("invalid wildcard %q, only one label can be *", name)
+		}
+		p.allowed = allowed
+		tt.patterns = append(tt.patterns, p)
+		return nil
+	}
+
+	fqdn := tt.prefix + name + tt.suffix
+	alias := name + tt.suffix
+	if def.Alias != "" {
+		alias = dns.Fqdn(strings.ToLower(def.Alias))
+		if strings.Contains(alias, "*") {
+			return fmt.Errorf("wildcards are not supported for txt_alias %q", alias)
+		}
+	}
+	if _, ok := tt.aliases[fqdn]; ok {
+		return fmt.Errorf("cannot have domain %q that is also in aliases", fqdn)
+	}
+	if def.Alias != "" {
+		if _, ok := tt.records[alias]; ok {
+			return fmt.Errorf("cannot have alias %q that is also in domains", alias)
+		}
+	}
+	if _, ok := tt.aliases[alias]; ok {
+		return fmt.Errorf("alias %q is already used by another record", alias)
+	}
+
+	r := &Record{fqdn: fqdn, store: tt.store, allowed: allowed}
+	tt.records[fqdn] = r
+	tt.aliases[alias] = r
+	return nil
+}
+
+// hasRecordLocked returns true if def is already defined.
+// The caller must hold tt.mtx.
+func (tt *TempTxt) hasRecordLocked(def recordDef) bool {
+	name := dns.Fqdn(strings.ToLower(def.FQDN))
+	if strings.Contains(name, "*") {
+		return tt.findPatternLocked(name) != -1
+	}
+	_, ok := tt.records[tt.prefix+name+tt.suffix]
+	return ok
+}
+
+// removeRecordLocked removes the record or pattern for name, which can be
+// the FQDN the record is served at or the name used for updates.
+// It returns the records that were removed, which for a pattern are the records
+// created from it, or false if there is no such record or pattern.
+// The caller must hold tt.mtx.
+func (tt *TempTxt) removeRecordLocked(name string) ([]*Record, bool) {
+	name = dns.Fqdn(strings.ToLower(name))
+	if strings.Contains(name, "*") {
+		i := tt.findPatternLocked(name)
+		if i == -1 {
+			return nil, false
+		}
+		p := tt.patterns[i]
+		tt.patterns = append(tt.patterns[:i:i], tt.patterns[i+1:]...)
+		// The records created from the pattern are removed with it
+		var removed []*Record
+		for _, r := range tt.records {
+			if r.pattern == p {
+				tt.deleteRecordLocked(r)
+				removed = append(removed, r)
+			}
+		}
+		return removed, true
+	}
+
+	r, ok := tt.records[name]
+	if !ok {
+		if r, ok = tt.aliases[name]; !ok {
+			return nil, false
+		}
+	}
+	tt.deleteRecordLocked(r)
+	return []*Record{r}, true
+}
+
+// deleteRecordLocked removes r and all of its aliases.
+// The caller must hold tt.mtx.
+func (tt *TempTxt) deleteRecordLocked(r *Record) {
+	delete(tt.records, r.fqdn)
+	for alias, ar := range tt.aliases {
+		if ar == r {
+			delete(tt.aliases, alias)
+		}
+	}
+	recordValues.DeleteLabelValues(r.fqdn)
+}
+
+// clearRecords removes the values of records that are no longer defined from the store
+// so they aren't served if the name is defined again.
+// The store can be slow, so tt.mtx shouldn't be held.
+func (tt *TempTxt) clearRecords(records []*Record) {
+	for _, r := range records {
+		_, err := r.store.Update(r.fqdn, func(RecordState) RecordState {
+			return RecordState{}
+		})
+		if err != nil {
+			log.Errorf("Error clearing %q: %v", r.fqdn, err)
+		}
+	}
+}
+
+// findPatternLocked returns the index of the pattern for name or -1.
+// name can include the PREFIX and SUFFIX.
+// The caller must hold tt.mtx.
+func (tt *TempTxt) findPatternLocked(name string) int {
+	for i, p := range tt.patterns {
+		n := p.head + "*" + p.tail
+		if name == n || name == p.prefix+n || name+tt.suffix == n {
+			return i
+		}
+	}
+	return -1
+}
+
+// recordDefs returns the definitions of all records and patterns sorted by FQDN.
+// The FQDN is the name the record is served at and Alias is the name used for updates
+// if it is different.
+func (tt *TempTxt) recordDefs() []recordDef {
+	tt.mtx.RLock()
+	defer tt.mtx.RUnlock()
+
+	aliases := make(map[*Record]string, len(tt.aliases))
+	for alias, r := range tt.aliases {
+		aliases[r] = alias
+	}
+
+	defs := make([]recordDef, 0, len(tt.records)+len(tt.patterns))
+	for fqdn, r := range tt.records {
+		def := recordDef{FQDN: fqdn, Allowed: allowedStrings(r.allowed)}
+		if alias, ok := aliases[r]; ok && alias != fqdn {
+			def.Alias = alias
+		}
+		defs = append(defs, def)
+	}
+	for _, p := range tt.patterns {
+		def := recordDef{FQDN: p.prefix + p.head + "*" + p.tail, Allowed: allowedStrings(p.allowed)}
+		if p.prefix != "" {
+			def.Alias = p.head + "*" + p.tail
+		}
+		defs = append(defs, def)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].FQDN < defs[j].FQDN })
+	return defs
+}
+
+// allowedStrings returns the regexps without the anchors added by addRecordLocked.
+func allowedStrings(allowed []*regexp.Regexp) []string {
+	s := make([]string, len(allowed))
+	for i, re := range allowed {
+		s[i] = strings.TrimSuffix(strings.TrimPrefix(re.String(), "^"), "$")
+	}
+	return s
+}
+
+// recordStatus is the response of GET /records/FQDN.
+type recordStatus struct {
+	FQDN    string        `json:"fqdn"`
+	Updated time.Time     `json:"updated"`
+	Values  []valueStatus `json:"values"`
+}
+
+type valueStatus struct {
+	Value   string    `json:"value"`
+	Created time.Time `json:"created"`
+	// Expires is when the value is removed by the cleaner.
+	// It is not set if clean_interval is 0.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// status returns the current values of the record. If clean is true,
+// the expiry times are set using maxAge.
+func (r *Record) status(maxAge time.Duration, clean bool) (recordStatus, error) {
+	rs, err := r.state()
+	if err != nil {
+		return recordStatus{}, err
+	}
+	s := recordStatus{FQDN: r.fqdn, Updated: rs.Updated, Values: make([]valueStatus, len(rs.Values))}
+	for i, v := range rs.Values {
+		s.Values[i] = valueStatus{Value: v.Txt, Created: v.Created}
+		if clean {
+			// Values are never older than the record so this is
+			// also before the whole record expires.
+			expires := v.Created.Add(maxAge)
+			s.Values[i].Expires = &expires
+		}
+	}
+	return s, nil
+}
+
+// recordHandler returns the current values of a record.
+// The record can be given by the name used for updates or the FQDN it is served at.
+func (tt *TempTxt) recordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := tt.getUser(w, r)
+	if !ok {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/records/")
+	if name == "" {
+		http.Error(w, "fqdn cannot be empty", http.StatusBadRequest)
+		return
+	}
+	name = dns.Fqdn(strings.ToLower(name))
+
+	record, ok := tt.getAlias(name)
+	if !ok {
+		record, _ = tt.getRecord(name)
+	}
+	if !authorize(w, record, name, user) {
+		return
+	}
+
+	status, err := record.status(tt.maxAge, tt.cleanInterval > 0)
+	if err != nil {
+		log.Errorf("Error getting values of %q: %v", record.fqdn, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Errorf("Error writing status of %q: %v", record.fqdn, err)
+	}
+}
@@ -0,0 +1,169 @@
+package temptxt
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAddRecord(t *testing.T) {
+	tt := newTestTempTxt(t)
+	tt.prefix = "_acme-challenge."
+
+	defs := []recordDef{
+		{FQDN: "test1.example.com", Allowed: []string{"user1"}},
+		{FQDN: "Test2.example.com.", Alias: "test2.example.org", Allowed: []string{"user2", "user[3-4]"}},
+		{FQDN: "*.apps.example.com", Allowed: []string{"user-(.*)"}},
+	}
+	for i, def := range defs {
+		if err := tt.addRecordLocked(def); err != nil {
+			t.Fatalf("[%d] Unexpected error: %v", i, err)
+		}
+	}
+
+	want := []recordDef{
+		{FQDN: "_acme-challenge.*.apps.example.com.", Alias: "*.apps.example.com.", Allowed: []string{"user-(.*)"}},
+		{FQDN: "_acme-challenge.test1.example.com.", Alias: "test1.example.com.", Allowed: []string{"user1"}},
+		{FQDN: "_acme-challenge.test2.example.com.", Alias: "test2.example.org.", Allowed: []string{"user2", "user[3-4]"}},
+	}
+	if have := tt.recordDefs(); !reflect.DeepEqual(have, want) {
+		t.Errorf("Expected %v, got %v", want, have)
+	}
+
+	for _, def := range defs {
+		if !tt.hasRecordLocked(def) {
+			t.Errorf("Expected %q to exist", def.FQDN)
+		}
+	}
+}
+
+func TestAddRecordErrors(t *testing.T) {
+	tests := []recordDef{
+		{Allowed: []string{"user1"}},
+		{FQDN: "test.example.com"},
+		{FQDN: "test.example.com", Allowed: []string{"("}},
+		{FQDN: "*.example.com", Alias: "test.example.com", Allowed: []string{"user1"}},
+		{FQDN: "test.example.com", Alias: "*.example.com", Allowed: []string{"user1"}},
+		{FQDN: "*.*.example.com", Allowed: []string{"user1"}},
+		// Conflicts with the existing alias
+		{FQDN: "alias.example.com", Allowed: []string{"user1"}},
+		// Conflicts with the existing record
+		{FQDN: "other.example.com", Alias: "existing.example.com", Allowed: []string{"user1"}},
+		// Alias is already used by the existing record
+		{FQDN: "other.example.com", Alias: "alias.example.com", Allowed: []string{"user1"}},
+	}
+
+	for i, def := range tests {
+		tt := newTestTempTxt(t, recordDef{FQDN: "existing.example.com", Alias: "alias.example.com", Allowed: []string{"user1"}})
+		if err := tt.addRecordLocked(def); err == nil {
+			t.Errorf("[%d] Expected error but got nil", i)
+		}
+	}
+}
+
+func TestRemoveRecord(t *testing.T) {
+	tt := newTestTempTxt(t)
+	tt.prefix = "_acme-challenge."
+	for _, def := range []recordDef{
+		{FQDN: "test1.example.com", Allowed: []string{"user1"}},
+		{FQDN: "test2.example.com", Alias: "test2.example.org", Allowed: []string{"user2"}},
+		{FQDN: "*.apps.example.com", Allowed: []string{"user3"}},
+	} {
+		if err := tt.addRecordLocked(def); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	// Records created from the pattern are removed with it
+	if r := tt.aliasOrPattern("test.apps.example.com.", "user3"); r == nil || tt.records["_acme-challenge.test.apps.example.com."] != r {
+		t.Fatalf("Expected a record to be created from the pattern")
+	}
+
+	// By the served FQDN, the update FQDN and the pattern
+	for _, name := range []string{"_acme-challenge.test1.example.com", "test2.example.org.", "*.apps.example.com"} {
+		if _, ok := tt.removeRecordLocked(name); !ok {
+			t.Errorf("Expected %q to be removed", name)
+		}
+	}
+	if _, ok := tt.removeRecordLocked("test1.example.com"); ok {
+		t.Errorf("Expected false for a missing record")
+	}
+	if len(tt.records) != 0 || len(tt.aliases) != 0 || len(tt.patterns) != 0 {
+		t.Errorf("Expected no records, got %v", tt.recordDefs())
+	}
+}
+
+func TestRecordHandler(t *testing.T) {
+	created := time.Now().Add(-time.Minute).Round(0).UTC()
+	tt := newTestTempTxt(t)
+	tt.prefix = "_acme-challenge."
+	tt.maxAge = 5 * time.Minute
+	tt.cleanInterval = time.Minute
+	if err := tt.addRecordLocked(recordDef{FQDN: "test1.example.com", Allowed: []string{"user1"}}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	setStates(t, tt.store, map[string]RecordState{
+		"_acme-challenge.test1.example.com.": {Values: []Value{{Txt: "a", Created: created}}, Updated: created},
+	})
+
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	// By the update FQDN and the FQDN it is served at
+	for _, name := range []string{"test1.example.com", "_acme-challenge.test1.example.com."} {
+		resp := sendRequest(t, "GET", s.URL+"/records/"+name, "", "user1")
+		assertStatus(http.StatusOK, resp, t)
+		status := recordStatus{}
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatalf("Error decoding response: %v", err)
+		}
+		resp.Body.Close()
+
+		expires := created.Add(tt.maxAge)
+		want := recordStatus{
+			FQDN:    "_acme-challenge.test1.example.com.",
+			Updated: created,
+			Values:  []valueStatus{{Value: "a", Created: created, Expires: &expires}},
+		}
+		if !reflect.DeepEqual(status, want) {
+			t.Errorf("[%s] Expected %+v, got %+v", name, want, status)
+		}
+	}
+
+	tests := []struct {
+		method string
+		name   string
+		user   string
+		want   int
+	}{
+		{method: "GET", name: "test1.example.com", user: "", want: http.StatusUnauthorized},
+		{method: "GET", name: "test1.example.com", user: "user2", want: http.StatusForbidden},
+		{method: "GET", name: "test2.example.com", user: "user1", want: http.StatusNotFound},
+		{method: "GET", name: "", user: "user1", want: http.StatusBadRequest},
+		{method: "PUT", name: "test1.example.com", user: "user1", want: http.StatusMethodNotAllowed},
+	}
+	for i, tc := range tests {
+		resp := sendRequest(t, tc.method, s.URL+"/records/"+tc.name, "", tc.user)
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("[%d] Expected status code %d, got %d", i, tc.want, resp.StatusCode)
+		}
+	}
+}
+
+// Values don't expire if the records are never cleaned.
+func TestRecordStatusNoClean(t *testing.T) {
+	r := &Record{fqdn: "test.example.com.", store: newMemoryStore()}
+	if err := r.add(Value{Txt: "a"}, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	s, err := r.status(time.Minute, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if s.Values[0].Expires != nil {
+		t.Errorf("Expected no expiry, got %v", s.Values[0].Expires)
+	}
+}
@@ -0,0 +1,170 @@
+package temptxt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultRecordsReload = 5 * time.Second
+
+// recordsFile is a file with record definitions.
+type recordsFile struct {
+	path   string
+	reload time.Duration
+	mod    fileMod
+	// names are the records that were added from the file
+	// so they can be removed when it changes.
+	names []string
+}
+
+// recordsFileContent is the format of the records file.
+type recordsFileContent struct {
+	Records []recordDef `json:"records" yaml:"records"`
+}
+
+// readRecordsFile reads the definitions in path.
+// Files ending in .json are read as JSON, everything else as YAML.
+func readRecordsFile(path string) ([]recordDef, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	content := recordsFileContent{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(b, &content)
+	} else {
+		err = yaml.Unmarshal(b, &content)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return content.Records, nil
+}
+
+// loadRecordsFile replaces the records from the records file if it has changed.
+func (tt *TempTxt) loadRecordsFile() error {
+	changed, err := tt.recordsFile.mod.changed(tt.recordsFile.path)
+	if err != nil || !changed {
+		return err
+	}
+	defs, err := readRecordsFile(tt.recordsFile.path)
+	if err != nil {
+		return err
+	}
+
+	tt.mtx.Lock()
+	removed, err := tt.setFileRecordsLocked(defs)
+	tt.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	tt.clearRecords(removed)
+
+	// Metrics are removed with the records, so they are set again.
+	for _, r := range tt.allRecords() {
+		if s, err := r.state(); err == nil {
+			r.setValuesMetric(len(s.Values))
+		}
+	}
+	return nil
+}
+
+// setFileRecordsLocked replaces the records from the records file with defs.
+// If any of the definitions are invalid, nothing is changed.
+// Records that are in both keep their values.
+// Records created from a pattern in the file are removed with the pattern and
+// created again from the new one when they are next used, so the users of a
+// changed pattern apply to them straight away.
+// It returns the records that are no longer defined so their values can be cleared.
+// The caller must hold tt.mtx.
+func (tt *TempTxt) setFileRecordsLocked(defs []recordDef) ([]*Record, error) {
+	// Make the changes to a copy so they can be discarded
+	next := &TempTxt{
+		prefix:   tt.prefix,
+		suffix:   tt.suffix,
+		store:    tt.store,
+		records:  make(map[string]*Record, len(tt.records)),
+		aliases:  make(map[string]*Record, len(tt.aliases)),
+		patterns: append([]*pattern(nil), tt.patterns...),
+	}
+	for k, v := range tt.records {
+		next.records[k] = v
+	}
+	for k, v := range tt.aliases {
+		next.aliases[k] = v
+	}
+	for _, name := range tt.recordsFile.names {
+		next.removeRecordLocked(name)
+	}
+
+	names := make([]string, 0, len(defs))
+	for _, def := range defs {
+		if next.hasRecordLocked(def) {
+			return nil, fmt.Errorf("record %q is already defined", def.FQDN)
+		}
+		if err := next.addRecordLocked(def); err != nil {
+			return nil, err
+		}
+		names = append(names, tt.prefix+dns.Fqdn(strings.ToLower(def.FQDN))+tt.suffix)
+	}
+
+	for fqdn, r := range next.records {
+		old, ok := tt.records[fqdn]
+		if !ok || old == r {
+			continue
+		}
+		old.mtx.Lock()
+		old.allowed = r.allowed
+		old.label = r.label
+		old.mtx.Unlock()
+		next.records[fqdn] = old
+		for alias, ar := range next.aliases {
+			if ar == r {
+				next.aliases[alias] = old
+			}
+		}
+	}
+
+	var removed []*Record
+	for fqdn, r := range tt.records {
+		if _, ok := next.records[fqdn]; ok {
+			continue
+		}
+		if p, _ := next.matchPatternFQDNLocked(fqdn); p != nil {
+			continue
+		}
+		removed = append(removed, r)
+	}
+
+	tt.records = next.records
+	tt.aliases = next.aliases
+	tt.patterns = next.patterns
+	tt.recordsFile.names = names
+	return removed, nil
+}
+
+// runRecordsFile reloads the records file when it changes.
+func (tt *TempTxt) runRecordsFile(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(tt.recordsFile.reload)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := tt.loadRecordsFile(); err != nil {
+					log.Errorf("Error reloading records file %q: %v", tt.recordsFile.path, err)
+				}
+			}
+		}
+	}()
+}
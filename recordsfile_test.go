@@ -0,0 +1,248 @@
+package temptxt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+func TestReadRecordsFile(t *testing.T) {
+	dir := t.TempDir()
+	want := []recordDef{
+		{FQDN: "test1.example.com", Allowed: []string{"user1"}},
+		{FQDN: "test2.example.com", Alias: "test2.example.org", Allowed: []string{"user2", "user3"}},
+	}
+
+	yamlFile := writeFile(t, dir, "records.yaml", []byte(`records:
+  - fqdn: test1.example.com
+    allowed: [user1]
+  - fqdn: test2.example.com
+    alias: test2.example.org
+    allowed:
+      - user2
+      - user3
+`))
+	jsonFile := writeFile(t, dir, "records.json", []byte(`{"records": [
+	{"fqdn": "test1.example.com", "allowed": ["user1"]},
+	{"fqdn": "test2.example.com", "alias": "test2.example.org", "allowed": ["user2", "user3"]}
+]}`))
+
+	for _, path := range []string{yamlFile, jsonFile} {
+		have, err := readRecordsFile(path)
+		if err != nil {
+			t.Errorf("[%s] Unexpected error: %v", path, err)
+			continue
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("[%s] Expected %v, got %v", path, want, have)
+		}
+	}
+
+	invalid := writeFile(t, dir, "invalid.json", []byte("records:"))
+	if _, err := readRecordsFile(invalid); err == nil {
+		t.Errorf("Expected error but got nil")
+	}
+}
+
+// rewriteFile replaces the content of path and makes sure the change is detected.
+func rewriteFile(t *testing.T, path string, data string, mtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("Error setting mtime: %v", err)
+	}
+}
+
+func TestRecordsFileReload(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "records.yaml", []byte(`records:
+  - fqdn: test1.example.com
+    allowed: [user1]
+  - fqdn: test2.example.com
+    allowed: [user2]
+`))
+
+	tt, err := parseConfig(caddy.NewTestController("dns", `temptxt _acme-challenge. {
+	txt static.example.com user3
+	records_file `+path+` 0
+}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if tt.recordsFile.reload != 0 {
+		t.Errorf("Expected reload to be 0, got %v", tt.recordsFile.reload)
+	}
+
+	test1 := tt.records["_acme-challenge.test1.example.com."]
+	if test1 == nil {
+		t.Fatalf("Expected test1 to be loaded")
+	}
+	if err := test1.add(Value{Txt: "a"}, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	test2 := tt.records["_acme-challenge.test2.example.com."]
+	if err := test2.add(Value{Txt: "b"}, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// test1 changes users, test2 is removed and test4 is added
+	rewriteFile(t, path, `records:
+  - fqdn: test1.example.com
+    allowed: [user4]
+  - fqdn: test4.example.com
+    allowed: [user4]
+`, time.Now().Add(time.Minute))
+	if err := tt.loadRecordsFile(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	r, ok := tt.getAlias("test1.example.com.")
+	if !ok || r != test1 {
+		t.Fatalf("Expected test1 to be kept")
+	}
+	if want := []string{"a"}; !reflect.DeepEqual(valuesOf(t, r), want) {
+		t.Errorf("Expected content %v, got %v", want, valuesOf(t, r))
+	}
+	if r.IsAuthorized("user1") || !r.IsAuthorized("user4") {
+		t.Errorf("Expected test1 to only allow user4")
+	}
+	if _, ok := tt.getAlias("test2.example.com."); ok {
+		t.Errorf("Expected test2 to be removed")
+	}
+	if values := valuesOf(t, test2); len(values) != 0 {
+		t.Errorf("Expected the values of test2 to be cleared, got %v", values)
+	}
+	for _, name := range []string{"test4.example.com.", "static.example.com."} {
+		if _, ok := tt.getAlias(name); !ok {
+			t.Errorf("Expected %q to exist", name)
+		}
+	}
+}
+
+// Records created from a pattern should use the users in the file after it changes.
+func TestRecordsFileReloadPattern(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "records.yaml", []byte(`records:
+  - fqdn: "*.apps.example.com"
+    allowed: [user1]
+`))
+
+	tt, err := parseConfig(caddy.NewTestController("dns", `temptxt _acme-challenge. {
+	records_file `+path+` 0
+}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	resp := sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "test.apps.example.com", "content": "a"}`, "user1")
+	resp.Body.Close()
+	assertStatus(http.StatusNoContent, resp, t)
+
+	// user1 is revoked
+	rewriteFile(t, path, `records:
+  - fqdn: "*.apps.example.com"
+    allowed: [user2]
+`, time.Now().Add(time.Minute))
+	if err := tt.loadRecordsFile(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp = sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "test.apps.example.com", "content": "b"}`, "user1")
+	resp.Body.Close()
+	assertStatus(http.StatusForbidden, resp, t)
+
+	resp = sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "test.apps.example.com", "content": "b"}`, "user2")
+	resp.Body.Close()
+	assertStatus(http.StatusNoContent, resp, t)
+	r, ok := tt.getAlias("test.apps.example.com.")
+	if !ok {
+		t.Fatalf("Expected the record to exist")
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(valuesOf(t, r), want) {
+		t.Errorf("Expected content %v, got %v", want, valuesOf(t, r))
+	}
+
+	// The pattern is removed
+	rewriteFile(t, path, "records: []\n", time.Now().Add(2*time.Minute))
+	if err := tt.loadRecordsFile(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := tt.getAlias("test.apps.example.com."); ok {
+		t.Errorf("Expected the record to be removed with the pattern")
+	}
+}
+
+// Invalid files should not change the records.
+func TestRecordsFileReloadInvalid(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "records.yaml", []byte(`records:
+  - fqdn: test1.example.com
+    allowed: [user1]
+`))
+
+	tt, err := parseConfig(caddy.NewTestController("dns", `temptxt {
+	txt static.example.com user3
+	records_file `+path+`
+}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := tt.recordDefs()
+
+	tests := []string{
+		// Conflicts with the Corefile
+		"records:\n  - fqdn: static.example.com\n    allowed: [user1]\n",
+		// Duplicate
+		"records:\n  - fqdn: test2.example.com\n    allowed: [user1]\n  - fqdn: test2.example.com\n    allowed: [user2]\n",
+		// No users
+		"records:\n  - fqdn: test2.example.com\n",
+		"invalid",
+	}
+
+	for i, data := range tests {
+		rewriteFile(t, path, data, time.Now().Add(time.Duration(i+1)*time.Minute))
+		if err := tt.loadRecordsFile(); err == nil {
+			t.Errorf("[%d] Expected error but got nil", i)
+		}
+		if have := tt.recordDefs(); !reflect.DeepEqual(have, want) {
+			t.Errorf("[%d] Expected %v, got %v", i, want, have)
+		}
+	}
+}
+
+func TestRecordsFileConfigErrors(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "records.yaml", []byte(`records:
+  - fqdn: static.example.com
+    allowed: [user1]
+`))
+
+	tests := []string{
+		`temptxt {
+	records_file
+}`,
+		`temptxt {
+	records_file ` + path + ` invalid
+}`,
+		`temptxt {
+	records_file ` + path + ` 5s extra
+}`,
+		`temptxt {
+	records_file /nonexistent/records.yaml
+}`,
+		`temptxt {
+	txt static.example.com user1
+	records_file ` + path + `
+}`,
+	}
+
+	for i, body := range tests {
+		if _, err := parseConfig(caddy.NewTestController("dns", body)); err == nil {
+			t.Errorf("[%d] Expected error but got nil", i)
+		}
+	}
+}
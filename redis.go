@@ -0,0 +1,158 @@
+package temptxt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	defaultRedisPrefix = "temptxt:"
+	// redisTimeout is short so queries are passed to the next plugin
+	// before the client gives up if Redis is unavailable.
+	redisTimeout = time.Second
+	// redisMaxAttempts is the number of times an update is tried
+	// when the record is changed by another instance at the same time.
+	redisMaxAttempts = 10
+)
+
+func init() {
+	RegisterStore("redis", newRedisStoreFactory)
+}
+
+// redisStore keeps the state of each record as JSON in a Redis key.
+// Keys expire maxAge after the record was last updated.
+type redisStore struct {
+	client *redis.Client
+	prefix string
+	maxAge time.Duration
+}
+
+// newRedisStoreFactory creates a redis store from "ADDRESS [PREFIX]".
+// ADDRESS is either HOST:PORT or a redis:// URL.
+func newRedisStoreFactory(args []string, opts StoreOptions) (Store, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return nil, fmt.Errorf("redis store takes an address and an optional key prefix")
+	}
+
+	ro := &redis.Options{Addr: args[0]}
+	if strings.Contains(args[0], "://") {
+		var err error
+		if ro, err = redis.ParseURL(args[0]); err != nil {
+			return nil, err
+		}
+	}
+	ro.DialTimeout = redisTimeout
+	ro.ReadTimeout = redisTimeout
+	ro.WriteTimeout = redisTimeout
+
+	prefix := defaultRedisPrefix
+	if len(args) == 2 {
+		prefix = args[1]
+	}
+	return newRedisStore(redis.NewClient(ro), prefix, opts.MaxAge), nil
+}
+
+func newRedisStore(client *redis.Client, prefix string, maxAge time.Duration) *redisStore {
+	return &redisStore{client: client, prefix: prefix, maxAge: maxAge}
+}
+
+// Get implements Store.
+func (s *redisStore) Get(fqdn string) (RecordState, error) {
+	return getRedisState(context.Background(), s.client, s.prefix+fqdn)
+}
+
+// Update implements Store. The key is watched so that concurrent updates
+// from other instances are retried instead of being lost.
+func (s *redisStore) Update(fqdn string, fn func(RecordState) RecordState) (RecordState, error) {
+	ctx := context.Background()
+	key := s.prefix + fqdn
+
+	var state RecordState
+	update := func(tx *redis.Tx) error {
+		old, err := getRedisState(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		state = fn(old)
+
+		ttl := s.maxAge - time.Since(state.Updated)
+		if ttl <= 0 {
+			// The record has expired, which also covers the zero state
+			state = RecordState{}
+		}
+		var b []byte
+		if ttl > 0 {
+			if b, err = json.Marshal(state); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if ttl > 0 {
+				pipe.Set(ctx, key, b, ttl)
+			} else {
+				pipe.Del(ctx, key)
+			}
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < redisMaxAttempts; i++ {
+		err := s.client.Watch(ctx, update, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			if err != nil {
+				return RecordState{}, err
+			}
+			return state, nil
+		}
+	}
+	return RecordState{}, fmt.Errorf("%q was changed %d times while updating it", fqdn, redisMaxAttempts)
+}
+
+// Names implements Store.
+func (s *redisStore) Names() ([]string, error) {
+	ctx := context.Background()
+	var names []string
+	iter := s.client.Scan(ctx, 0, s.prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		names = append(names, strings.TrimPrefix(iter.Val(), s.prefix))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Close implements Store.
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
+
+// redisGetter is implemented by both redis.Client and redis.Tx.
+type redisGetter interface {
+	Get(ctx context.Context, key string) *redis.StringCmd
+}
+
+// getRedisState returns the state stored at key or the zero state if there is none.
+func getRedisState(ctx context.Context, c redisGetter, key string) (RecordState, error) {
+	b, err := c.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return RecordState{}, nil
+	} else if err != nil {
+		return RecordState{}, err
+	}
+	state := RecordState{}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return RecordState{}, fmt.Errorf("invalid state for %q: %v", key, err)
+	}
+	return state, nil
+}
@@ -0,0 +1,150 @@
+package temptxt
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/go-redis/redis/v8"
+	"github.com/miekg/dns"
+)
+
+// newTestRedis returns a client for a new in-process Redis server.
+func newTestRedis(t *testing.T) *redis.Client {
+	t.Helper()
+	m := miniredis.NewMiniRedis()
+	if err := m.Start(); err != nil {
+		t.Fatalf("Error starting Redis: %v", err)
+	}
+	t.Cleanup(m.Close)
+	return redis.NewClient(&redis.Options{Addr: m.Addr()})
+}
+
+func newRedisTempTxt(t *testing.T, addr string) *TempTxt {
+	t.Helper()
+	tt, err := parseConfig(caddy.NewTestController("dns", `temptxt _acme-challenge. {
+	txt test1.example.com user1
+	txt empty.example.com user1
+	txt *.apps.example.com user-(.*)
+	store redis `+addr+` test:
+}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { tt.store.Close() })
+	tt.Next = testHandler()
+	return tt
+}
+
+func redisQuery(t *testing.T, tt *TempTxt, qname string) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(qname, dns.TypeTXT)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := tt.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	return rec.Msg
+}
+
+// Keys should expire max_age after the record was last updated.
+func TestRedisStoreTTL(t *testing.T) {
+	m := miniredis.NewMiniRedis()
+	if err := m.Start(); err != nil {
+		t.Fatalf("Error starting Redis: %v", err)
+	}
+	defer m.Close()
+	s := newRedisStore(redis.NewClient(&redis.Options{Addr: m.Addr()}), defaultRedisPrefix, 5*time.Minute)
+	defer s.Close()
+
+	updated := time.Now().Add(-time.Minute)
+	setStates(t, s, map[string]RecordState{
+		"test1.example.com.": {Values: []Value{{Txt: "a", Created: updated}}, Updated: updated},
+		// Already expired
+		"test2.example.com.": {Values: []Value{{Txt: "b", Created: updated}}, Updated: time.Now().Add(-10 * time.Minute)},
+	})
+
+	if ttl := m.TTL(defaultRedisPrefix + "test1.example.com."); ttl <= 3*time.Minute || ttl > 4*time.Minute {
+		t.Errorf("Expected a TTL of about 4m, got %v", ttl)
+	}
+	if m.Exists(defaultRedisPrefix + "test2.example.com.") {
+		t.Errorf("Expected the expired record not to be stored")
+	}
+
+	m.FastForward(5 * time.Minute)
+	if names, err := s.Names(); err != nil || len(names) != 0 {
+		t.Errorf("Expected no names after the TTL, got %v, %v", names, err)
+	}
+}
+
+// Instances using the same Redis should serve the same values,
+// including records created from a pattern by the other instance.
+func TestRedisSharedState(t *testing.T) {
+	m := miniredis.NewMiniRedis()
+	if err := m.Start(); err != nil {
+		t.Fatalf("Error starting Redis: %v", err)
+	}
+	defer m.Close()
+
+	a, b := newRedisTempTxt(t, m.Addr()), newRedisTempTxt(t, m.Addr())
+	s := httptest.NewServer(a.handler())
+	defer s.Close()
+
+	for _, tc := range []struct {
+		body string
+		user string
+		name string
+	}{
+		{body: `{"fqdn": "test1.example.com", "content": "a"}`, user: "user1", name: "_acme-challenge.test1.example.com."},
+		{body: `{"fqdn": "web01.apps.example.com", "content": "b"}`, user: "user-web01", name: "_acme-challenge.web01.apps.example.com."},
+	} {
+		resp := sendRequest(t, "PUT", s.URL+"/update", tc.body, tc.user)
+		resp.Body.Close()
+		assertStatus(http.StatusNoContent, resp, t)
+
+		msg := redisQuery(t, b, tc.name)
+		if len(msg.Answer) != 1 {
+			t.Errorf("[%s] Expected 1 answer from the other instance, got %v", tc.name, msg.Answer)
+		}
+	}
+
+	// Records from patterns in Redis are created when loading
+	c := newRedisTempTxt(t, m.Addr())
+	if _, ok := c.getAlias("web01.apps.example.com."); !ok {
+		t.Errorf("Expected the pattern record to be loaded")
+	}
+}
+
+// Queries should be passed to the next plugin when Redis is unavailable.
+func TestRedisUnavailable(t *testing.T) {
+	m := miniredis.NewMiniRedis()
+	if err := m.Start(); err != nil {
+		t.Fatalf("Error starting Redis: %v", err)
+	}
+	addr := m.Addr()
+	m.Close()
+
+	// Starting must not fail
+	tt := newRedisTempTxt(t, addr)
+
+	for _, qname := range []string{"_acme-challenge.empty.example.com.", "_acme-challenge.web01.apps.example.com."} {
+		msg := redisQuery(t, tt, qname)
+		if qname == "_acme-challenge.empty.example.com." {
+			assertRRs(t, 0, "answer", []string{`_acme-challenge.empty.example.com.	300	IN	TXT	"fallthrough"`}, msg.Answer)
+		} else if msg.Rcode != dns.RcodeServerFailure {
+			t.Errorf("[%s] Expected the query to be passed to the next plugin, got %v", qname, msg)
+		}
+	}
+
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+	resp := sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "test1.example.com", "content": "a"}`, "user1")
+	resp.Body.Close()
+	assertStatus(http.StatusInternalServerError, resp, t)
+}
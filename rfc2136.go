@@ -0,0 +1,253 @@
+package temptxt
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// tsigFudge is the allowed time difference for signed responses.
+const tsigFudge = 300
+
+// tsigKey is a TSIG key that can be used to send RFC 2136 updates.
+type tsigKey struct {
+	// secret is the base64 encoded secret.
+	secret string
+	// user is matched against the allowed regexps of the records.
+	user string
+}
+
+// updateOp is a single validated change from an RFC 2136 update.
+type updateOp struct {
+	record *Record
+	// name is set if record is from a pattern and has to be added before it is updated.
+	name  string
+	class uint16
+	value string
+	// strings are the character-strings of the value if there is more than one.
+	strings []string
+}
+
+// serveUpdate handles RFC 2136 DNS UPDATE messages for the records.
+// Updates must be signed with one of the configured TSIG keys.
+func (tt *TempTxt) serveUpdate(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	if len(tt.tsigKeys) == 0 || !tt.isOurUpdate(r) {
+		return plugin.NextOrFailure(tt.Name(), tt.Next, ctx, w, r)
+	}
+
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		tt.auditUpdate(w, "", "", "", dns.RcodeFormatError)
+		return tt.updateError(w, r, dns.RcodeFormatError)
+	}
+	zone := strings.ToLower(r.Question[0].Name)
+
+	t := r.IsTsig()
+	if t == nil {
+		log.Errorf("Refused unsigned update for zone %q", zone)
+		tt.auditUpdate(w, "", zone, "", dns.RcodeRefused)
+		return tt.updateError(w, r, dns.RcodeRefused)
+	}
+	key, ok := tt.tsigKeys[strings.ToLower(t.Hdr.Name)]
+	if !ok || !verifyTsig(r, key.secret) {
+		log.Errorf("Invalid TSIG signature from key %q for zone %q", t.Hdr.Name, zone)
+		tt.auditUpdate(w, "", zone, "", dns.RcodeNotAuth)
+		return tt.updateError(w, r, dns.RcodeNotAuth)
+	}
+
+	// Prerequisites are not supported
+	if len(r.Answer) > 0 {
+		return tt.rejectUpdate(w, r, t, key, zone, "", dns.RcodeNotImplemented)
+	}
+
+	if tt.rateLimit != nil {
+		if ok, _ := tt.rateLimit.allow(key.user); !ok {
+			log.Errorf("Rate limit exceeded by user %q", key.user)
+			return tt.rejectUpdate(w, r, t, key, zone, "", dns.RcodeRefused)
+		}
+	}
+
+	// Validate everything first so an invalid update makes no changes.
+	// Records from patterns are only added once the whole update is valid.
+	// The changes are then applied one at a time, so a store error can leave
+	// part of the update applied.
+	ops := make([]updateOp, 0, len(r.Ns))
+	for _, rr := range r.Ns {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+
+		if !dns.IsSubDomain(zone, name) {
+			return tt.rejectUpdate(w, r, t, key, name, "", dns.RcodeNotZone)
+		}
+
+		record, recordName := tt.lookupRecord(name)
+		if record == nil {
+			return tt.rejectUpdate(w, r, t, key, name, "", dns.RcodeNotZone)
+		}
+
+		if !record.IsAuthorized(key.user) {
+			log.Errorf("Unauthorized update for %q from user %q", name, key.user)
+			return tt.rejectUpdate(w, r, t, key, name, record.fqdn, dns.RcodeRefused)
+		}
+
+		op := updateOp{record: record, name: recordName, class: hdr.Class}
+		switch hdr.Class {
+		case dns.ClassINET, dns.ClassNONE:
+			txt, ok := rr.(*dns.TXT)
+			if !ok {
+				return tt.rejectUpdate(w, r, t, key, name, record.fqdn, dns.RcodeRefused)
+			}
+			op.value = strings.Join(txt.Txt, "")
+			if len(op.value) > tt.valueLimit() {
+				return tt.rejectUpdate(w, r, t, key, name, record.fqdn, dns.RcodeFormatError)
+			}
+			if len(txt.Txt) > 1 {
+				op.strings = txt.Txt
+			}
+		case dns.ClassANY:
+			if hdr.Rrtype != dns.TypeTXT && hdr.Rrtype != dns.TypeANY {
+				continue
+			}
+		default:
+			return tt.rejectUpdate(w, r, t, key, name, record.fqdn, dns.RcodeFormatError)
+		}
+		ops = append(ops, op)
+	}
+
+	records := make([]*Record, 0, len(ops))
+	var err error
+	rcode := dns.RcodeSuccess
+	for _, op := range ops {
+		if op.name != "" {
+			op.record = tt.addPatternRecord(op.name, op.record)
+		}
+		entry := auditEntry{
+			Source:     auditSourceRFC2136,
+			User:       key.user,
+			RemoteAddr: w.RemoteAddr().String(),
+			FQDN:       op.record.fqdn,
+			Record:     op.record.fqdn,
+			Value:      op.value,
+			Rcode:      dns.RcodeToString[dns.RcodeSuccess],
+		}
+		changed := true
+		switch op.class {
+		case dns.ClassINET:
+			entry.Action = ActionAdd
+			err = tt.addValue(op.record, Value{Txt: op.value, Strings: op.strings})
+		case dns.ClassNONE:
+			entry.Action = ActionRemove
+			changed, err = op.record.remove(op.value)
+		case dns.ClassANY:
+			entry.Action = ActionClear
+			err = op.record.clear()
+		}
+		if err != nil {
+			log.Errorf("Error updating %q: %v", op.record.fqdn, err)
+			rcode = dns.RcodeServerFailure
+			// Limits are refused like unauthorized updates
+			var le *limitError
+			if errors.As(err, &le) {
+				rcode = dns.RcodeRefused
+			}
+			entry.Rcode = dns.RcodeToString[rcode]
+			tt.audit(entry)
+			break
+		}
+		tt.audit(entry)
+		if changed {
+			tt.notify(webhookEvent{Action: entry.Action, FQDN: entry.FQDN, Record: op.record.fqdn, User: key.user, Value: op.value})
+			records = append(records, op.record)
+		}
+	}
+	if len(records) > 0 {
+		tt.setModified()
+		tt.replicate(records...)
+	}
+	if err != nil {
+		return tt.writeUpdateResponse(w, r, t, key, rcode)
+	}
+
+	log.Infof("Received RFC 2136 update for zone %q from user %q", zone, key.user)
+
+	return tt.writeUpdateResponse(w, r, t, key, dns.RcodeSuccess)
+}
+
+// isOurUpdate returns true if any of the names in the update section are records
+// or match a pattern.
+func (tt *TempTxt) isOurUpdate(r *dns.Msg) bool {
+	for _, rr := range r.Ns {
+		name := strings.ToLower(rr.Header().Name)
+		if _, ok := tt.getRecord(name); ok {
+			return true
+		}
+		if p, _ := tt.matchPatternFQDN(name); p != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyTsig verifies the TSIG signature of r.
+// CoreDNS only passes the unpacked message to plugins, so it is packed again
+// with and without name compression before verifying.
+func verifyTsig(r *dns.Msg, secret string) bool {
+	for _, compress := range []bool{false, true} {
+		m := r.Copy()
+		m.Compress = compress
+		buf, err := m.Pack()
+		if err != nil {
+			continue
+		}
+		if err := dns.TsigVerify(buf, secret, "", false); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// auditUpdate writes an audit entry for an update of name that was rejected with rcode.
+// user is empty if the update isn't signed with a valid key.
+func (tt *TempTxt) auditUpdate(w dns.ResponseWriter, user string, name string, record string, rcode int) {
+	tt.audit(auditEntry{
+		Source:     auditSourceRFC2136,
+		User:       user,
+		RemoteAddr: w.RemoteAddr().String(),
+		FQDN:       name,
+		Record:     record,
+		Rcode:      dns.RcodeToString[rcode],
+	})
+}
+
+// rejectUpdate audits the rejected update and writes a response signed with key.
+func (tt *TempTxt) rejectUpdate(w dns.ResponseWriter, r *dns.Msg, t *dns.TSIG, key tsigKey, name string, record string, rcode int) (int, error) {
+	tt.auditUpdate(w, key.user, name, record, rcode)
+	return tt.writeUpdateResponse(w, r, t, key, rcode)
+}
+
+// updateError writes an unsigned error response.
+func (tt *TempTxt) updateError(w dns.ResponseWriter, r *dns.Msg, rcode int) (int, error) {
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	w.WriteMsg(m)
+	return rcode, nil
+}
+
+// writeUpdateResponse writes a response signed with key.
+func (tt *TempTxt) writeUpdateResponse(w dns.ResponseWriter, r *dns.Msg, t *dns.TSIG, key tsigKey, rcode int) (int, error) {
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	m.SetTsig(t.Hdr.Name, t.Algorithm, tsigFudge, time.Now().Unix())
+
+	buf, _, err := dns.TsigGenerate(m, key.secret, t.MAC, false)
+	if err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	if _, err := w.Write(buf); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	return rcode, nil
+}
@@ -0,0 +1,262 @@
+package temptxt
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+const testTsigSecret = "c2VjcmV0LXNlY3JldC1zZWNyZXQtc2VjcmV0"
+
+// rawWriter stores the raw response written by serveUpdate.
+type rawWriter struct {
+	test.ResponseWriter
+	buf []byte
+	msg *dns.Msg
+}
+
+func (w *rawWriter) Write(buf []byte) (int, error) {
+	w.buf = buf
+	return len(buf), nil
+}
+
+func (w *rawWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func newUpdateTempTxt(t *testing.T) *TempTxt {
+	t.Helper()
+	tt := newTestTempTxt(t,
+		recordDef{FQDN: "_acme-challenge.test1.example.com", Allowed: []string{"user1"}},
+		recordDef{FQDN: "_acme-challenge.test2.example.com", Allowed: []string{"user2"}},
+	)
+	tt.Next = testHandler()
+	tt.tsigKeys = map[string]tsigKey{
+		"key1.": {secret: testTsigSecret, user: "user1"},
+	}
+	return tt
+}
+
+// signedUpdate returns the update as it would be received by ServeDNS.
+func signedUpdate(t *testing.T, m *dns.Msg, key string, secret string, compress bool) *dns.Msg {
+	t.Helper()
+	m.Compress = compress
+	m.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+	buf, _, err := dns.TsigGenerate(m, secret, "", false)
+	if err != nil {
+		t.Fatalf("Error signing update: %v", err)
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil {
+		t.Fatalf("Error unpacking update: %v", err)
+	}
+	return req
+}
+
+func sendUpdate(t *testing.T, tt *TempTxt, req *dns.Msg) int {
+	t.Helper()
+	w := &rawWriter{}
+	code, err := tt.ServeDNS(context.Background(), w, req)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if w.buf == nil {
+		if w.msg == nil {
+			t.Fatal("Expected a response")
+		}
+		return w.msg.Rcode
+	}
+
+	if err := dns.TsigVerify(w.buf, testTsigSecret, req.IsTsig().MAC, false); err != nil {
+		t.Errorf("Error verifying response: %v", err)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(w.buf); err != nil {
+		t.Fatalf("Error unpacking response: %v", err)
+	}
+	if resp.Rcode != code {
+		t.Errorf("Expected rcode %s, but got %s", dns.RcodeToString[code], dns.RcodeToString[resp.Rcode])
+	}
+	return resp.Rcode
+}
+
+func TestUpdateAddAndDelete(t *testing.T) {
+	tt := newUpdateTempTxt(t)
+	record := tt.records["_acme-challenge.test1.example.com."]
+
+	for _, compress := range []bool{false, true} {
+		m := new(dns.Msg)
+		m.SetUpdate("example.com.")
+		m.Insert([]dns.RR{
+			test.TXT(`_acme-challenge.test1.example.com. 60 IN TXT "value1"`),
+			test.TXT(`_acme-challenge.test1.example.com. 60 IN TXT "value2"`),
+		})
+		if code := sendUpdate(t, tt, signedUpdate(t, m, "key1.", testTsigSecret, compress)); code != dns.RcodeSuccess {
+			t.Fatalf("Expected rcode %s, but got %s", dns.RcodeToString[dns.RcodeSuccess], dns.RcodeToString[code])
+		}
+		if want := []string{"value1", "value2"}; !reflect.DeepEqual(valuesOf(t, record), want) {
+			t.Errorf("Expected content %v, got %v", want, valuesOf(t, record))
+		}
+
+		m = new(dns.Msg)
+		m.SetUpdate("example.com.")
+		m.Remove([]dns.RR{test.TXT(`_acme-challenge.test1.example.com. 60 IN TXT "value1"`)})
+		if code := sendUpdate(t, tt, signedUpdate(t, m, "key1.", testTsigSecret, compress)); code != dns.RcodeSuccess {
+			t.Fatalf("Expected rcode %s, but got %s", dns.RcodeToString[dns.RcodeSuccess], dns.RcodeToString[code])
+		}
+		if want := []string{"value2"}; !reflect.DeepEqual(valuesOf(t, record), want) {
+			t.Errorf("Expected content %v, got %v", want, valuesOf(t, record))
+		}
+
+		m = new(dns.Msg)
+		m.SetUpdate("example.com.")
+		m.RemoveRRset([]dns.RR{test.TXT(`_acme-challenge.test1.example.com. 60 IN TXT "value2"`)})
+		if code := sendUpdate(t, tt, signedUpdate(t, m, "key1.", testTsigSecret, compress)); code != dns.RcodeSuccess {
+			t.Fatalf("Expected rcode %s, but got %s", dns.RcodeToString[dns.RcodeSuccess], dns.RcodeToString[code])
+		}
+		if l := len(valuesOf(t, record)); l != 0 {
+			t.Errorf("Expected length 0, but got %d", l)
+		}
+	}
+}
+
+// The character-strings of a TXT record should be kept.
+func TestUpdateStrings(t *testing.T) {
+	tt := newUpdateTempTxt(t)
+	record := tt.records["_acme-challenge.test1.example.com."]
+
+	m := new(dns.Msg)
+	m.SetUpdate("example.com.")
+	m.Insert([]dns.RR{test.TXT(`_acme-challenge.test1.example.com. 60 IN TXT "v=DKIM1; " "p=abc"`)})
+	if code := sendUpdate(t, tt, signedUpdate(t, m, "key1.", testTsigSecret, false)); code != dns.RcodeSuccess {
+		t.Fatalf("Expected rcode %s, but got %s", dns.RcodeToString[dns.RcodeSuccess], dns.RcodeToString[code])
+	}
+	s, err := record.state()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(s.Values) != 1 || s.Values[0].Txt != "v=DKIM1; p=abc" || !reflect.DeepEqual(s.Values[0].Strings, []string{"v=DKIM1; ", "p=abc"}) {
+		t.Errorf("Unexpected values %+v", s.Values)
+	}
+}
+
+func TestUpdateErrors(t *testing.T) {
+	tests := []struct {
+		zone   string
+		rr     string
+		key    string
+		secret string
+		want   int
+	}{
+		// Unauthorized user
+		{zone: "example.com.", rr: `_acme-challenge.test2.example.com. 60 IN TXT "a"`, key: "key1.", secret: testTsigSecret, want: dns.RcodeRefused},
+		// Unknown key
+		{zone: "example.com.", rr: `_acme-challenge.test1.example.com. 60 IN TXT "a"`, key: "key2.", secret: testTsigSecret, want: dns.RcodeNotAuth},
+		// Bad signature
+		{zone: "example.com.", rr: `_acme-challenge.test1.example.com. 60 IN TXT "a"`, key: "key1.", secret: "b3RoZXI=", want: dns.RcodeNotAuth},
+		// Not in zone
+		{zone: "example.org.", rr: `_acme-challenge.test1.example.com. 60 IN TXT "a"`, key: "key1.", secret: testTsigSecret, want: dns.RcodeNotZone},
+		// Unsupported type
+		{zone: "example.com.", rr: `_acme-challenge.test1.example.com. 60 IN A 127.0.0.1`, key: "key1.", secret: testTsigSecret, want: dns.RcodeRefused},
+	}
+
+	for i, tc := range tests {
+		tt := newUpdateTempTxt(t)
+		m := new(dns.Msg)
+		m.SetUpdate(tc.zone)
+		rr, err := dns.NewRR(tc.rr)
+		if err != nil {
+			t.Fatalf("[%d] Error parsing RR: %v", i, err)
+		}
+		m.Insert([]dns.RR{rr})
+		if code := sendUpdate(t, tt, signedUpdate(t, m, tc.key, tc.secret, false)); code != tc.want {
+			t.Errorf("[%d] Expected rcode %s, but got %s", i, dns.RcodeToString[tc.want], dns.RcodeToString[code])
+		}
+		if l := len(valuesOf(t, tt.records["_acme-challenge.test1.example.com."])); l != 0 {
+			t.Errorf("[%d] Expected length 0, but got %d", i, l)
+		}
+	}
+}
+
+func TestUpdateUnsigned(t *testing.T) {
+	tt := newUpdateTempTxt(t)
+	m := new(dns.Msg)
+	m.SetUpdate("example.com.")
+	m.Insert([]dns.RR{test.TXT(`_acme-challenge.test1.example.com. 60 IN TXT "a"`)})
+	if code := sendUpdate(t, tt, m); code != dns.RcodeRefused {
+		t.Errorf("Expected rcode %s, but got %s", dns.RcodeToString[dns.RcodeRefused], dns.RcodeToString[code])
+	}
+}
+
+// Updates for other names should be passed to the next plugin.
+func TestUpdateFallthrough(t *testing.T) {
+	tt := newUpdateTempTxt(t)
+	m := new(dns.Msg)
+	m.SetUpdate("example.com.")
+	m.Insert([]dns.RR{test.TXT(`other.example.com. 60 IN TXT "a"`)})
+	code, _ := tt.ServeDNS(context.Background(), &rawWriter{}, m)
+	if code != dns.RcodeServerFailure {
+		t.Errorf("Expected rcode %s, but got %s", dns.RcodeToString[dns.RcodeServerFailure], dns.RcodeToString[code])
+	}
+}
+
+func TestUpdatePattern(t *testing.T) {
+	tt := newUpdateTempTxt(t)
+	tt.aliases = make(map[string]*Record)
+	p := newPattern("_acme-challenge.", "*.apps.example.com.")
+	p.allowed = []*regexp.Regexp{regexp.MustCompile("^user(.*)$")}
+	tt.patterns = []*pattern{p}
+
+	tests := []struct {
+		rr   string
+		want int
+	}{
+		{rr: `_acme-challenge.2.apps.example.com. 60 IN TXT "a"`, want: dns.RcodeRefused},
+		{rr: `_acme-challenge.1.apps.example.com. 60 IN TXT "a"`, want: dns.RcodeSuccess},
+	}
+
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetUpdate("example.com.")
+		m.Insert([]dns.RR{test.TXT(tc.rr)})
+		if code := sendUpdate(t, tt, signedUpdate(t, m, "key1.", testTsigSecret, false)); code != tc.want {
+			t.Errorf("[%d] Expected rcode %s, but got %s", i, dns.RcodeToString[tc.want], dns.RcodeToString[code])
+		}
+	}
+
+	if _, ok := tt.records["_acme-challenge.2.apps.example.com."]; ok {
+		t.Errorf("Expected no record for an unauthorized update")
+	}
+	if r, ok := tt.records["_acme-challenge.1.apps.example.com."]; !ok || len(valuesOf(t, r)) != 1 {
+		t.Errorf("Expected the record to be created")
+	}
+}
+
+// Records from patterns shouldn't be created if the update is rejected.
+func TestUpdatePatternRejected(t *testing.T) {
+	tt := newUpdateTempTxt(t)
+	tt.aliases = make(map[string]*Record)
+	p := newPattern("_acme-challenge.", "*.apps.example.com.")
+	p.allowed = []*regexp.Regexp{regexp.MustCompile("^user1$")}
+	tt.patterns = []*pattern{p}
+
+	m := new(dns.Msg)
+	m.SetUpdate("example.com.")
+	m.Insert([]dns.RR{
+		test.TXT(`_acme-challenge.1.apps.example.com. 60 IN TXT "a"`),
+		// Not authorized
+		test.TXT(`_acme-challenge.test2.example.com. 60 IN TXT "a"`),
+	})
+	if code := sendUpdate(t, tt, signedUpdate(t, m, "key1.", testTsigSecret, false)); code != dns.RcodeRefused {
+		t.Errorf("Expected rcode %s, but got %s", dns.RcodeToString[dns.RcodeRefused], dns.RcodeToString[code])
+	}
+	if _, ok := tt.records["_acme-challenge.1.apps.example.com."]; ok {
+		t.Errorf("Expected no record to be created")
+	}
+}
@@ -2,8 +2,13 @@ package temptxt
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"net"
+	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -11,6 +16,7 @@ import (
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
+	ctls "github.com/coredns/coredns/plugin/pkg/tls"
 	"github.com/miekg/dns"
 )
 
@@ -39,6 +45,35 @@ func setup(c *caddy.Controller) error {
 		c.OnShutdown(func() error { cancel(); return nil })
 	}
 
+	if tt.auth != nil && tt.auth.reload > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		tt.auth.Run(ctx)
+		c.OnShutdown(func() error { cancel(); return nil })
+	}
+
+	if tt.peers != nil && tt.peers.sync > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		tt.runPeers(ctx)
+		c.OnShutdown(func() error { cancel(); return nil })
+	}
+
+	if tt.webhook != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		tt.webhook.run(ctx)
+		c.OnShutdown(func() error { cancel(); return nil })
+	}
+
+	if tt.recordsFile != nil && tt.recordsFile.reload > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		tt.runRecordsFile(ctx)
+		c.OnShutdown(func() error { cancel(); return nil })
+	}
+
+	c.OnShutdown(tt.store.Close)
+	if tt.auditLog != nil {
+		c.OnShutdown(tt.auditLog.Close)
+	}
+
 	c.OnStartup(tt.OnStartup)
 	c.OnRestart(tt.OnFinalShutdown)
 	c.OnFinalShutdown(tt.OnFinalShutdown)
@@ -58,13 +93,24 @@ func parseConfig(c *caddy.Controller) (*TempTxt, error) {
 		maxAge:        defaultMaxAge,
 		cleanInterval: defaultCleanInterval,
 		listenAddr:    defaultListenAddr,
+		waitTimeout:   defaultWaitTimeout,
 	}
 
 	tt.records = make(map[string]*Record)
 	tt.aliases = make(map[string]*Record)
 
-	var prefix string
-	var suffix string
+	acmeDNSMaxAccounts := defaultAcmeDNSMaxAccounts
+	var soaArgs []string
+	var dnssecKeys []string
+	var peerURLs []string
+	var peerSecret string
+	peerSync := defaultPeerSync
+	storeName := "memory"
+	var storeArgs []string
+	var webhookURL string
+	var webhookSecret string
+	var auditDest string
+	auditHash := false
 
 	c.Next() // Skip "temptxt"
 
@@ -73,13 +119,13 @@ func parseConfig(c *caddy.Controller) (*TempTxt, error) {
 		return nil, c.ArgErr()
 	}
 	if len(args) >= 1 {
-		prefix = args[0]
-		if prefix != "" && !strings.HasSuffix(prefix, ".") {
-			prefix += "."
+		tt.prefix = args[0]
+		if tt.prefix != "" && !strings.HasSuffix(tt.prefix, ".") {
+			tt.prefix += "."
 		}
 	}
 	if len(args) == 2 {
-		suffix = strings.TrimLeft(dns.Fqdn(args[1]), ".")
+		tt.suffix = strings.TrimLeft(dns.Fqdn(args[1]), ".")
 	}
 
 	for c.NextBlock() {
@@ -89,13 +135,32 @@ func parseConfig(c *caddy.Controller) (*TempTxt, error) {
 				return nil, c.ArgErr()
 			}
 			tt.authHeader = c.Val()
+		case "trusted_proxies":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			for _, a := range args {
+				if !strings.Contains(a, "/") {
+					if ip := net.ParseIP(a); ip != nil && ip.To4() != nil {
+						a += "/32"
+					} else {
+						a += "/128"
+					}
+				}
+				_, n, err := net.ParseCIDR(a)
+				if err != nil {
+					return nil, c.Errf("Invalid network %q: %v", a, err)
+				}
+				tt.trustedProxies = append(tt.trustedProxies, n)
+			}
 		case "txt_alias":
-			err := addRecord(tt, c, prefix, suffix, true)
+			err := addRecord(tt, c, true)
 			if err != nil {
 				return nil, err
 			}
 		case "txt":
-			err := addRecord(tt, c, prefix, suffix, false)
+			err := addRecord(tt, c, false)
 			if err != nil {
 				return nil, err
 			}
@@ -128,52 +193,391 @@ func parseConfig(c *caddy.Controller) (*TempTxt, error) {
 				return nil, c.Errf("Invalid listen address: %v", err)
 			}
 			tt.listenAddr = c.Val()
+		case "acme_dns":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			tt.acmeDNS = &acmeDNS{
+				zone:     dns.Fqdn(strings.ToLower(c.Val())),
+				accounts: make(map[string]*acmeDNSAccount),
+			}
+			for _, u := range c.RemainingArgs() {
+				regexp, err := regexp.Compile("^" + u + "$")
+				if err != nil {
+					return nil, c.Errf("Unable to compile regexp: %v", err)
+				}
+				tt.acmeDNS.allowed = append(tt.acmeDNS.allowed, regexp)
+			}
+		case "acme_dns_max_accounts":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			n, err := strconv.Atoi(c.Val())
+			if err != nil || n < 1 {
+				return nil, c.Errf("Invalid acme_dns_max_accounts %q", c.Val())
+			}
+			acmeDNSMaxAccounts = n
+		case "admin":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			for _, u := range args {
+				regexp, err := regexp.Compile("^" + u + "$")
+				if err != nil {
+					return nil, c.Errf("Unable to compile regexp: %v", err)
+				}
+				tt.admins = append(tt.admins, regexp)
+			}
+		case "tsig":
+			args := c.RemainingArgs()
+			if len(args) < 2 || len(args) > 3 {
+				return nil, c.ArgErr()
+			}
+			if _, err := base64.StdEncoding.DecodeString(args[1]); err != nil {
+				return nil, c.Errf("Invalid TSIG secret for key %q: %v", args[0], err)
+			}
+			name := dns.Fqdn(strings.ToLower(args[0]))
+			user := strings.TrimSuffix(name, ".")
+			if len(args) == 3 {
+				user = args[2]
+			}
+			if tt.tsigKeys == nil {
+				tt.tsigKeys = make(map[string]tsigKey)
+			}
+			tt.tsigKeys[name] = tsigKey{secret: args[1], user: user}
+		case "tls":
+			args := c.RemainingArgs()
+			if len(args) < 2 || len(args) > 3 {
+				return nil, c.ArgErr()
+			}
+			tlsConfig, err := ctls.NewTLSConfigFromArgs(args...)
+			if err != nil {
+				return nil, c.Errf("Error loading TLS config: %v", err)
+			}
+			if len(args) == 3 {
+				// NewTLSConfigFromArgs only sets RootCAs
+				tlsConfig.ClientCAs = tlsConfig.RootCAs
+				tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			tlsConfig.MinVersion = tls.VersionTLS12
+			tt.tlsConfig = tlsConfig
+		case "records_file":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return nil, c.ArgErr()
+			}
+			tt.recordsFile = &recordsFile{path: args[0], reload: defaultRecordsReload}
+			if len(args) == 2 {
+				reload, err := time.ParseDuration(args[1])
+				if err != nil {
+					return nil, c.Errf("Error parsing duration %q", args[1])
+				}
+				tt.recordsFile.reload = reload
+			}
+		case "nameservers":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			for _, a := range args {
+				if _, _, err := net.SplitHostPort(a); err != nil {
+					a = net.JoinHostPort(a, "53")
+				}
+				if _, _, err := net.SplitHostPort(a); err != nil {
+					return nil, c.Errf("Invalid nameserver %q: %v", a, err)
+				}
+				tt.nameservers = append(tt.nameservers, a)
+			}
+		case "wait_timeout":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			timeout, err := time.ParseDuration(c.Val())
+			if err != nil {
+				return nil, c.Errf("Error parsing duration %q", c.Val())
+			}
+			tt.waitTimeout = timeout
+		case "peers":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			for _, a := range args {
+				u, err := url.Parse(a)
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+					return nil, c.Errf("Invalid peer URL %q", a)
+				}
+			}
+			peerURLs = append(peerURLs, args...)
+		case "peer_secret":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			peerSecret = c.Val()
+		case "peer_sync":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			sync, err := time.ParseDuration(c.Val())
+			if err != nil {
+				return nil, c.Errf("Error parsing duration %q", c.Val())
+			}
+			peerSync = sync
+		case "auth":
+			a, err := parseAuth(c)
+			if err != nil {
+				return nil, err
+			}
+			tt.auth = a
+		case "ttl":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			ttl, err := strconv.ParseUint(c.Val(), 10, 32)
+			if err != nil {
+				return nil, c.Errf("Invalid TTL %q", c.Val())
+			}
+			tt.ttl = uint32(ttl)
+		case "soa":
+			soaArgs = c.RemainingArgs()
+			if len(soaArgs) == 0 || len(soaArgs) > 3 {
+				return nil, c.ArgErr()
+			}
+		case "dnssec":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			dnssecKeys = append(dnssecKeys, args...)
+		case "store":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			storeName = c.Val()
+			storeArgs = c.RemainingArgs()
+		case "max_value_length":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			n, err := strconv.Atoi(c.Val())
+			if err != nil || n < 1 || n > maxValueLengthLimit {
+				return nil, c.Errf("Invalid max_value_length %q, must be between 1 and %d", c.Val(), maxValueLengthLimit)
+			}
+			tt.maxValueLength = n
+		case "max_values", "max_bytes", "rate_limit":
+			name := c.Val()
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			n, err := strconv.Atoi(c.Val())
+			if err != nil || n < 1 {
+				return nil, c.Errf("Invalid %s %q", name, c.Val())
+			}
+			switch name {
+			case "max_values":
+				tt.maxValues = n
+			case "max_bytes":
+				tt.maxBytes = n
+			default:
+				tt.rateLimit = newRateLimiter(n)
+			}
+		case "webhook":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			u, err := url.Parse(c.Val())
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, c.Errf("Invalid webhook URL %q", c.Val())
+			}
+			webhookURL = c.Val()
+		case "webhook_secret":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			webhookSecret = c.Val()
+		case "audit":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[1] != "hash") {
+				return nil, c.ArgErr()
+			}
+			auditDest = args[0]
+			auditHash = len(args) == 2
+		case "persist":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			storeName = "file"
+			storeArgs = []string{c.Val()}
 		default:
 			return nil, c.ArgErr()
 		}
 	}
 
+	// The SOA is created last since it uses the TTL
+	if len(soaArgs) > 0 {
+		zone := dns.Fqdn(strings.ToLower(soaArgs[0]))
+		mname := zone
+		rname := "hostmaster." + zone
+		if len(soaArgs) >= 2 {
+			mname = dns.Fqdn(strings.ToLower(soaArgs[1]))
+		}
+		if len(soaArgs) == 3 {
+			rname = dns.Fqdn(strings.ToLower(soaArgs[2]))
+		}
+		tt.soa = newSOA(zone, mname, rname, tt.ttl)
+	}
+
+	if tt.acmeDNS != nil {
+		tt.acmeDNS.maxAccounts = acmeDNSMaxAccounts
+	}
+
+	if len(dnssecKeys) > 0 {
+		if tt.soa == nil {
+			return nil, c.Err("dnssec requires soa")
+		}
+		signer, keys, err := newSigner(tt.soa.Hdr.Name, dnssecKeys)
+		if err != nil {
+			return nil, c.Err(err.Error())
+		}
+		tt.signer = signer
+		tt.keys = keys
+	}
+
+	if len(peerURLs) > 0 {
+		if peerSecret == "" {
+			return nil, c.Err("peers requires peer_secret")
+		}
+		tt.peers = &peers{
+			urls:   peerURLs,
+			secret: []byte(peerSecret),
+			sync:   peerSync,
+			client: &http.Client{Timeout: 10 * time.Second},
+		}
+	}
+
+	if webhookURL != "" {
+		if webhookSecret == "" {
+			return nil, c.Err("webhook requires webhook_secret")
+		}
+		tt.webhook = newWebhook(webhookURL, webhookSecret)
+	}
+
+	store, err := newStore(storeName, storeArgs, StoreOptions{MaxAge: tt.maxAge})
+	if err != nil {
+		return nil, c.Errf("Error creating %s store: %v", storeName, err)
+	}
+	tt.store = store
+	for _, r := range tt.records {
+		r.store = store
+	}
+
+	if tt.recordsFile != nil {
+		if err := tt.loadRecordsFile(); err != nil {
+			store.Close()
+			return nil, c.Errf("Error loading records file %q: %v", tt.recordsFile.path, err)
+		}
+	}
+
+	if tt.acmeDNS != nil {
+		// Clients CNAME to the subdomains of the accounts, so they must not be lost
+		if _, ok := store.(accountStore); !ok {
+			store.Close()
+			return nil, c.Errf("acme_dns requires a store that keeps accounts, %s doesn't", storeName)
+		}
+		if err := tt.loadAcmeDNSAccounts(); err != nil {
+			store.Close()
+			return nil, c.Errf("Error loading acme-dns accounts: %v", err)
+		}
+	}
+
+	// The store may be shared and temporarily unavailable.
+	// Records from patterns are then created when they are queried.
+	if err := tt.loadStore(); err != nil {
+		log.Errorf("Error loading %s store: %v", storeName, err)
+	}
+
+	if auditDest != "" {
+		a, err := newAuditLog(auditDest, auditHash)
+		if err != nil {
+			store.Close()
+			return nil, c.Errf("Error opening audit log %q: %v", auditDest, err)
+		}
+		tt.auditLog = a
+	}
+
 	return tt, nil
 }
 
-func addRecord(tt *TempTxt, c *caddy.Controller, prefix string, suffix string, hasAlias bool) error {
-	if !c.NextArg() {
-		return c.ArgErr()
+// parseAuth parses the auth block.
+// NextBlock doesn't support nested blocks so the tokens are read until the closing brace.
+func parseAuth(c *caddy.Controller) (*auth, error) {
+	if !c.NextArg() || c.Val() != "{" {
+		return nil, c.ArgErr()
 	}
-	r := &Record{}
 
-	alias := (dns.Fqdn(strings.ToLower(c.Val())))
-	fqdn := prefix + alias + suffix
-	if !hasAlias {
-		alias += suffix
+	a := &auth{reload: defaultAuthReload}
+	closed := false
+	for !closed && c.Next() {
+		switch c.Val() {
+		case "}":
+			closed = true
+		case "htpasswd":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			a.htpasswdFile = c.Val()
+		case "tokens":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			a.tokensFile = c.Val()
+		case "reload":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			duration, err := time.ParseDuration(c.Val())
+			if err != nil {
+				return nil, c.Errf("Error parsing duration %q", c.Val())
+			}
+			if duration < 0 {
+				return nil, c.Errf("reload cannot be negative")
+			}
+			a.reload = duration
+		default:
+			return nil, c.ArgErr()
+		}
+	}
+
+	if !closed {
+		return nil, c.EOFErr()
+	}
+	if a.htpasswdFile == "" && a.tokensFile == "" {
+		return nil, c.Errf("auth requires htpasswd or tokens")
 	}
-	if _, ok := tt.aliases[fqdn]; ok {
-		return c.Errf("Cannot have domain %q that is also in aliases", fqdn)
+	if err := a.load(); err != nil {
+		return nil, c.Errf("Error loading auth files: %v", err)
 	}
-	tt.records[fqdn] = r
+	return a, nil
+}
 
+func addRecord(tt *TempTxt, c *caddy.Controller, hasAlias bool) error {
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	def := recordDef{FQDN: c.Val()}
 	if hasAlias {
 		if !c.NextArg() {
 			return c.ArgErr()
 		}
-		alias = dns.Fqdn(strings.ToLower(c.Val()))
-		if _, ok := tt.records[alias]; ok {
-			return c.Errf("Cannot have alias %q that is also in domains", fqdn)
-		}
+		def.Alias = c.Val()
 	}
-	tt.aliases[alias] = r
-
-	args := c.RemainingArgs()
-	if len(args) == 0 {
+	def.Allowed = c.RemainingArgs()
+	if len(def.Allowed) == 0 {
 		return c.ArgErr()
 	}
-	for _, u := range args {
-		regexp, err := regexp.Compile("^" + u + "$")
-		if err != nil {
-			return c.Errf("Unable to compile regexp: %v", err)
-		}
-
-		r.allowed = append(r.allowed, regexp)
+	if err := tt.addRecordLocked(def); err != nil {
+		return c.Err(err.Error())
 	}
 	return nil
 }
@@ -2,6 +2,9 @@ package temptxt
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/coredns/caddy"
@@ -98,6 +101,207 @@ func TestConfigErrors(t *testing.T) {
 		// 18. clean_interval < 60
 		`temptxt {
 	clean_interval 30s
+}`,
+		// 19. No path for persist
+		`temptxt {
+	persist
+}`,
+		// 20. No zone for acme_dns
+		`temptxt {
+	acme_dns
+}`,
+		// 21. Invalid regexp for acme_dns
+		`temptxt {
+	acme_dns acme-dns.example.com (?!)
+}`,
+		// 22. Invalid acme_dns_max_accounts
+		`temptxt {
+	acme_dns acme-dns.example.com
+	acme_dns_max_accounts abc
+}`,
+		// 23. No secret for tsig
+		`temptxt {
+	tsig key.example.com
+}`,
+		// 24. Invalid secret for tsig
+		`temptxt {
+	tsig key.example.com notbase64!
+}`,
+		// 25. Extra args for tsig
+		`temptxt {
+	tsig key.example.com c2VjcmV0 user1 extra
+}`,
+		// 26. No key for tls
+		`temptxt {
+	tls cert.pem
+}`,
+		// 27. Missing files for tls
+		`temptxt {
+	tls /does/not/exist.pem /does/not/exist.key
+}`,
+		// 28. No block for auth
+		`temptxt {
+	auth
+}`,
+		// 29. Empty auth block
+		`temptxt {
+	auth {
+	}
+}`,
+		// 30. Invalid option in auth
+		`temptxt {
+	auth {
+		invalid option
+	}
+}`,
+		// 31. No file for htpasswd
+		`temptxt {
+	auth {
+		htpasswd
+	}
+}`,
+		// 32. Invalid reload duration
+		`temptxt {
+	auth {
+		tokens /does/not/exist
+		reload invalid
+	}
+}`,
+		// 33. Missing tokens file
+		`temptxt {
+	auth {
+		tokens /does/not/exist
+	}
+}`,
+		// 34. No networks for trusted_proxies
+		`temptxt {
+	trusted_proxies
+}`,
+		// 35. Invalid network for trusted_proxies
+		`temptxt {
+	trusted_proxies 10.0.0.0/8 invalid
+}`,
+		// 36. No value for ttl
+		`temptxt {
+	ttl
+}`,
+		// 37. Invalid ttl
+		`temptxt {
+	ttl -1
+}`,
+		// 38. No zone for soa
+		`temptxt {
+	soa
+}`,
+		// 39. Too many args for soa
+		`temptxt {
+	soa example.com ns1.example.com hostmaster.example.com extra
+}`,
+		// 40. Wildcard in txt_alias
+		`temptxt {
+	txt_alias *.example.com test.example.org user1
+}`,
+		// 41. Partial wildcard label
+		`temptxt {
+	txt web*.example.com user1
+}`,
+		// 42. Multiple wildcards
+		`temptxt {
+	txt *.*.example.com user1
+}`,
+		// 43. No users for a wildcard
+		`temptxt {
+	txt *.example.com
+}`,
+		// 44. No nameservers
+		`temptxt {
+	nameservers
+}`,
+		// 45. Invalid wait_timeout
+		`temptxt {
+	wait_timeout abc
+}`,
+		// 46. peers without peer_secret
+		`temptxt {
+	peers http://192.0.2.1:8080
+}`,
+		// 47. Invalid peer URL
+		`temptxt {
+	peers 192.0.2.1:8080
+	peer_secret secret
+}`,
+		// 48. Invalid peer_sync
+		`temptxt {
+	peers http://192.0.2.1:8080
+	peer_secret secret
+	peer_sync abc
+}`,
+		// 49. No store name
+		`temptxt {
+	store
+}`,
+		// 50. Unknown store
+		`temptxt {
+	store does-not-exist
+}`,
+		// 51. No path for the file store
+		`temptxt {
+	store file
+}`,
+		// 52. acme_dns with a store that doesn't keep accounts
+		`temptxt {
+	acme_dns acme-dns.example.com
+	store memory
+}`,
+		// 53. No address for the redis store
+		`temptxt {
+	store redis
+}`,
+		// 54. No destination for audit
+		`temptxt {
+	audit
+}`,
+		// 55. Invalid audit option
+		`temptxt {
+	audit /tmp/audit.log sha1
+}`,
+		// 56. Audit log in a missing directory
+		`temptxt {
+	audit /tmp/temptxt-does-not-exist/audit.log
+}`,
+		// 57. webhook without webhook_secret
+		`temptxt {
+	webhook http://192.0.2.1/hook
+}`,
+		// 58. Invalid webhook URL
+		`temptxt {
+	webhook 192.0.2.1/hook
+	webhook_secret secret
+}`,
+		// 59. No webhook_secret
+		`temptxt {
+	webhook http://192.0.2.1/hook
+	webhook_secret
+}`,
+		// 60. Invalid max_values
+		`temptxt {
+	max_values abc
+}`,
+		// 61. max_bytes must be positive
+		`temptxt {
+	max_bytes 0
+}`,
+		// 62. No rate_limit
+		`temptxt {
+	rate_limit
+}`,
+		// 63. max_value_length too large
+		`temptxt {
+	max_value_length 100000
+}`,
+		// 64. Invalid max_value_length
+		`temptxt {
+	max_value_length 0
 }`,
 	}
 
@@ -123,6 +327,9 @@ func getConfig(cfg string, t *testing.T) *TempTxt {
 // but is useless.
 func TestMinimal(t *testing.T) {
 	c := getConfig("temptxt", t)
+	if c.valueLimit() != defaultMaxValueLength {
+		t.Errorf("Expected %d, but got %d", defaultMaxValueLength, c.valueLimit())
+	}
 	if c.authHeader != defaultAuthHeader {
 		t.Errorf("Expected %q, but got %q", defaultAuthHeader, c.authHeader)
 	}
@@ -353,6 +560,195 @@ func TestListen(t *testing.T) {
 	}
 }
 
+func TestPersist(t *testing.T) {
+	body := `temptxt {
+	persist /tmp/temptxt-does-not-exist/state.json
+}`
+	c := getConfig(body, t)
+	s, ok := c.store.(*fileStore)
+	if !ok {
+		t.Fatalf("Expected a file store, got %T", c.store)
+	}
+	if want := "/tmp/temptxt-does-not-exist/state.json"; s.path != want {
+		t.Errorf("Got %s, expected %s", s.path, want)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	c := getConfig(`temptxt {
+	audit `+path+` hash
+}`, t)
+	if c.auditLog == nil || !c.auditLog.hash {
+		t.Fatalf("Expected an audit log with hashed values")
+	}
+	defer c.auditLog.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected the audit log to be created: %v", err)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	c := getConfig(`temptxt {
+	webhook https://192.0.2.1/hook
+	webhook_secret secret
+}`, t)
+	if c.webhook == nil {
+		t.Fatalf("Expected a webhook")
+	}
+	if c.webhook.url != "https://192.0.2.1/hook" || string(c.webhook.secret) != "secret" {
+		t.Errorf("Unexpected webhook %q with secret %q", c.webhook.url, c.webhook.secret)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	c := getConfig(`temptxt {
+	max_value_length 2048
+	max_values 5
+	max_bytes 1000
+	rate_limit 10
+}`, t)
+	if c.valueLimit() != 2048 {
+		t.Errorf("Expected max value length %d, got %d", 2048, c.valueLimit())
+	}
+	if c.maxValues != 5 {
+		t.Errorf("Expected max values %d, got %d", 5, c.maxValues)
+	}
+	if c.maxBytes != 1000 {
+		t.Errorf("Expected max bytes %d, got %d", 1000, c.maxBytes)
+	}
+	if c.rateLimit == nil || c.rateLimit.limit != 10 {
+		t.Errorf("Expected a rate limit of %d, got %+v", 10, c.rateLimit)
+	}
+}
+
+func TestStore(t *testing.T) {
+	tests := []struct {
+		body string
+		want Store
+	}{
+		{body: `temptxt`, want: &memoryStore{}},
+		{body: `temptxt {
+	store memory
+}`, want: &memoryStore{}},
+		{body: `temptxt {
+	store file /tmp/temptxt-does-not-exist/state.json
+}`, want: &fileStore{}},
+	}
+
+	for i, tc := range tests {
+		c := getConfig(tc.body, t)
+		if have, want := reflect.TypeOf(c.store), reflect.TypeOf(tc.want); have != want {
+			t.Errorf("[%d] Expected a %v, got %v", i, want, have)
+		}
+	}
+}
+
+func TestAcmeDNS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	body := `temptxt {
+	acme_dns acme-dns.EXAMPLE.com user1 user2
+	persist ` + path + `
+}`
+	c := getConfig(body, t)
+	if c.acmeDNS == nil {
+		t.Fatal("Expected acmeDNS to be set")
+	}
+	if want := "acme-dns.example.com."; c.acmeDNS.zone != want {
+		t.Errorf("Got %s, expected %s", c.acmeDNS.zone, want)
+	}
+	if len(c.acmeDNS.allowed) != 2 {
+		t.Errorf("Expected 2 allowed users, got %d", len(c.acmeDNS.allowed))
+	}
+	if c.acmeDNS.maxAccounts != defaultAcmeDNSMaxAccounts {
+		t.Errorf("Expected max accounts %d, got %d", defaultAcmeDNSMaxAccounts, c.acmeDNS.maxAccounts)
+	}
+
+	c = getConfig(`temptxt {
+	acme_dns_max_accounts 10
+	acme_dns acme-dns.example.com
+	persist `+path+`
+}`, t)
+	if c.acmeDNS.maxAccounts != 10 {
+		t.Errorf("Expected max accounts %d, got %d", 10, c.acmeDNS.maxAccounts)
+	}
+}
+
+func TestTsig(t *testing.T) {
+	body := `temptxt {
+	tsig KEY1.example.com c2VjcmV0
+	tsig key2.example.com. c2VjcmV0 user2
+}`
+	c := getConfig(body, t)
+
+	want := map[string]tsigKey{
+		"key1.example.com.": {secret: "c2VjcmV0", user: "key1.example.com"},
+		"key2.example.com.": {secret: "c2VjcmV0", user: "user2"},
+	}
+	if !reflect.DeepEqual(c.tsigKeys, want) {
+		t.Errorf("Expected %v, got %v", want, c.tsigKeys)
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	body := `temptxt {
+	trusted_proxies 10.0.0.0/8 192.0.2.1 2001:db8::/32 2001:db8:1::1
+}`
+	c := getConfig(body, t)
+
+	want := []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::/32", "2001:db8:1::1/128"}
+	if len(c.trustedProxies) != len(want) {
+		t.Fatalf("Expected %d networks, got %d", len(want), len(c.trustedProxies))
+	}
+	for i, n := range c.trustedProxies {
+		if n.String() != want[i] {
+			t.Errorf("[%d] Expected %s, got %s", i, want[i], n)
+		}
+	}
+}
+
+func TestSOA(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{
+			body: `temptxt {
+	soa acme.EXAMPLE.com
+}`,
+			want: "acme.example.com.\t0\tIN\tSOA\tacme.example.com. hostmaster.acme.example.com. 1 7200 1800 86400 0",
+		},
+		{
+			body: `temptxt {
+	soa acme.example.com ns1.example.com admin.example.com
+	ttl 30
+}`,
+			want: "acme.example.com.\t30\tIN\tSOA\tns1.example.com. admin.example.com. 1 7200 1800 86400 30",
+		},
+	}
+
+	for i, tc := range tests {
+		c := getConfig(tc.body, t)
+		if c.soa == nil {
+			t.Errorf("[%d] Expected soa to be set", i)
+			continue
+		}
+		if c.soa.String() != tc.want {
+			t.Errorf("[%d] Expected %q, got %q", i, tc.want, c.soa.String())
+		}
+	}
+}
+
+func TestTTL(t *testing.T) {
+	body := `temptxt {
+	ttl 60
+}`
+	c := getConfig(body, t)
+	if c.ttl != 60 {
+		t.Errorf("Got %d, expected %d", c.ttl, 60)
+	}
+}
+
 func TestCleanInterval(t *testing.T) {
 	body := `temptxt {
 	clean_interval 15m
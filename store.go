@@ -0,0 +1,169 @@
+package temptxt
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Value is a single value of a record.
+type Value struct {
+	// Txt is split into character-strings of 255 bytes in answers unless Strings is set.
+	Txt string `json:"value"`
+	// Strings are the character-strings of the value if they were given explicitly.
+	// Txt is then the strings joined together.
+	Strings []string  `json:"strings,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// maxStringLength is the maximum length of a character-string in a TXT record.
+const maxStringLength = 255
+
+// txtStrings returns the character-strings of v for a TXT record.
+func (v Value) txtStrings() []string {
+	if len(v.Strings) > 0 {
+		return v.Strings
+	}
+	strs := make([]string, 0, len(v.Txt)/maxStringLength+1)
+	txt := v.Txt
+	for len(txt) > maxStringLength {
+		strs = append(strs, txt[:maxStringLength])
+		txt = txt[maxStringLength:]
+	}
+	return append(strs, txt)
+}
+
+// RecordState is the mutable state of a record.
+type RecordState struct {
+	Values  []Value   `json:"values"`
+	Updated time.Time `json:"updated"`
+}
+
+// Store stores the state of the records by FQDN.
+// The records themselves and who is allowed to update them are not stored.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Get returns the state of the record fqdn.
+	// The zero RecordState is returned if there is none.
+	Get(fqdn string) (RecordState, error)
+	// Update replaces the state of the record fqdn with the result of fn and returns it.
+	// fn may be called more than once so it must not have side effects.
+	Update(fqdn string, fn func(RecordState) RecordState) (RecordState, error)
+	// Names returns the FQDNs of the records that have a state.
+	Names() ([]string, error)
+	// Close releases any resources used by the store.
+	Close() error
+}
+
+// StoreOptions are passed to a StoreFactory.
+type StoreOptions struct {
+	// MaxAge is the configured max_age. Values older than this can be dropped.
+	MaxAge time.Duration
+}
+
+// StoreFactory creates a store from the arguments of the store directive.
+type StoreFactory func(args []string, opts StoreOptions) (Store, error)
+
+var (
+	storesMtx sync.RWMutex
+	stores    = map[string]StoreFactory{
+		"memory": newMemoryStoreFactory,
+		"file":   newFileStoreFactory,
+	}
+)
+
+// RegisterStore makes a store available as "store NAME ARGS..." in the Corefile.
+// It is meant to be called from the init function of the package implementing the store.
+func RegisterStore(name string, f StoreFactory) {
+	storesMtx.Lock()
+	defer storesMtx.Unlock()
+	stores[name] = f
+}
+
+// newStore creates the store name.
+func newStore(name string, args []string, opts StoreOptions) (Store, error) {
+	storesMtx.RLock()
+	f, ok := stores[name]
+	storesMtx.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown store %q", name)
+	}
+	return f(args, opts)
+}
+
+// memoryStore keeps the state in memory.
+type memoryStore struct {
+	mtx    sync.RWMutex
+	states map[string]RecordState
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{states: make(map[string]RecordState)}
+}
+
+func newMemoryStoreFactory(args []string, _ StoreOptions) (Store, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("memory store takes no arguments")
+	}
+	return newMemoryStore(), nil
+}
+
+// Get implements Store.
+func (s *memoryStore) Get(fqdn string) (RecordState, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.states[fqdn].copy(), nil
+}
+
+// Update implements Store.
+func (s *memoryStore) Update(fqdn string, fn func(RecordState) RecordState) (RecordState, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.updateLocked(fqdn, fn), nil
+}
+
+// updateLocked is like Update but the caller must hold s.mtx.
+func (s *memoryStore) updateLocked(fqdn string, fn func(RecordState) RecordState) RecordState {
+	state := fn(s.states[fqdn].copy())
+	if state.Updated.IsZero() && len(state.Values) == 0 {
+		delete(s.states, fqdn)
+	} else {
+		s.states[fqdn] = state.copy()
+	}
+	return state
+}
+
+// Names implements Store.
+func (s *memoryStore) Names() ([]string, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	names := make([]string, 0, len(s.states))
+	for name := range s.states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Close implements Store.
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// copy returns a copy of s that doesn't share the values.
+func (s RecordState) copy() RecordState {
+	if s.Values != nil {
+		s.Values = append([]Value(nil), s.Values...)
+	}
+	return s
+}
+
+// txts returns the TXT of every value.
+func (s RecordState) txts() []string {
+	txts := make([]string, len(s.Values))
+	for i, v := range s.Values {
+		txts[i] = v.Txt
+	}
+	return txts
+}
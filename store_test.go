@@ -0,0 +1,250 @@
+package temptxt
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+// useStore sets the store of tt and every record in it to s.
+// Records without an FQDN get the name they have in tt.records.
+func useStore(tt *TempTxt, s Store) {
+	tt.store = s
+	for name, r := range tt.records {
+		if r.fqdn == "" {
+			r.fqdn = name
+		}
+		r.store = s
+	}
+}
+
+// valuesOf returns the values of r and fails the test on error.
+func valuesOf(t *testing.T, r *Record) []string {
+	t.Helper()
+	values, err := r.values()
+	if err != nil {
+		t.Fatalf("Error getting values of %q: %v", r.fqdn, err)
+	}
+	return values
+}
+
+func TestStores(t *testing.T) {
+	tests := map[string]func(t *testing.T) Store{
+		"memory": func(t *testing.T) Store {
+			return newMemoryStore()
+		},
+		"file": func(t *testing.T) Store {
+			s, err := newFileStore(filepath.Join(t.TempDir(), "state.json"), time.Minute)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			return s
+		},
+		"redis": func(t *testing.T) Store {
+			return newRedisStore(newTestRedis(t), defaultRedisPrefix, time.Minute)
+		},
+	}
+
+	for name, newStore := range tests {
+		t.Run(name, func(t *testing.T) {
+			testStore(t, newStore(t))
+		})
+	}
+}
+
+// testStore checks the behaviour every Store must have.
+func testStore(t *testing.T, s Store) {
+	defer s.Close()
+
+	if state, err := s.Get("test.example.com."); err != nil || !reflect.DeepEqual(state, RecordState{}) {
+		t.Errorf("Expected the zero state, got %v, %v", state, err)
+	}
+
+	now := time.Now().Round(0)
+	want := RecordState{Values: []Value{{Txt: "a", Created: now}}, Updated: now}
+	state, err := s.Update("test.example.com.", func(s RecordState) RecordState {
+		s.Values = append(s.Values, Value{Txt: "a", Created: now})
+		s.Updated = now
+		return s
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(state, want) {
+		t.Errorf("Expected %v, got %v", want, state)
+	}
+
+	state, err = s.Get("test.example.com.")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !state.Updated.Equal(want.Updated) || !reflect.DeepEqual(state.txts(), []string{"a"}) {
+		t.Errorf("Expected %v, got %v", want, state)
+	}
+
+	// Changing the returned state must not change the store
+	state.Values[0].Txt = "changed"
+	if state, _ := s.Get("test.example.com."); state.Values[0].Txt != "a" {
+		t.Errorf("Expected the stored value to be unchanged, got %q", state.Values[0].Txt)
+	}
+
+	if names, err := s.Names(); err != nil || !reflect.DeepEqual(names, []string{"test.example.com."}) {
+		t.Errorf("Expected names %v, got %v, %v", []string{"test.example.com."}, names, err)
+	}
+
+	// Returning the zero state deletes the record
+	if _, err := s.Update("test.example.com.", func(RecordState) RecordState { return RecordState{} }); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if names, err := s.Names(); err != nil || len(names) != 0 {
+		t.Errorf("Expected no names, got %v, %v", names, err)
+	}
+}
+
+func TestValueTxtStrings(t *testing.T) {
+	a255 := strings.Repeat("a", 255)
+	tests := []struct {
+		value Value
+		want  []string
+	}{
+		{value: Value{Txt: "a"}, want: []string{"a"}},
+		{value: Value{Txt: a255}, want: []string{a255}},
+		{value: Value{Txt: a255 + "b"}, want: []string{a255, "b"}},
+		{value: Value{Txt: a255 + a255 + "c"}, want: []string{a255, a255, "c"}},
+		{value: Value{Txt: "ab", Strings: []string{"a", "b"}}, want: []string{"a", "b"}},
+	}
+	for i, tc := range tests {
+		if have := tc.value.txtStrings(); !reflect.DeepEqual(have, tc.want) {
+			t.Errorf("[%d] Expected %q, got %q", i, tc.want, have)
+		}
+	}
+}
+
+func TestNewStore(t *testing.T) {
+	if _, err := newStore("does-not-exist", nil, StoreOptions{}); err == nil {
+		t.Errorf("Expected an error for an unknown store")
+	}
+	if _, err := newStore("memory", []string{"arg"}, StoreOptions{}); err == nil {
+		t.Errorf("Expected an error for memory with arguments")
+	}
+	if _, err := newStore("file", nil, StoreOptions{}); err == nil {
+		t.Errorf("Expected an error for file without a path")
+	}
+
+	called := false
+	RegisterStore("test", func(args []string, opts StoreOptions) (Store, error) {
+		called = true
+		if want := []string{"a", "b"}; !reflect.DeepEqual(args, want) {
+			t.Errorf("Expected args %v, got %v", want, args)
+		}
+		if opts.MaxAge != time.Minute {
+			t.Errorf("Expected max age %v, got %v", time.Minute, opts.MaxAge)
+		}
+		return newMemoryStore(), nil
+	})
+	defer func() {
+		storesMtx.Lock()
+		delete(stores, "test")
+		storesMtx.Unlock()
+	}()
+
+	if _, err := newStore("test", []string{"a", "b"}, StoreOptions{MaxAge: time.Minute}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if !called {
+		t.Errorf("Expected the registered factory to be called")
+	}
+}
+
+// errStore is a store that is always unavailable.
+type errStore struct{}
+
+var errUnavailable = errors.New("store unavailable")
+
+func (errStore) Get(string) (RecordState, error) { return RecordState{}, errUnavailable }
+func (errStore) Update(string, func(RecordState) RecordState) (RecordState, error) {
+	return RecordState{}, errUnavailable
+}
+func (errStore) Names() ([]string, error) { return nil, errUnavailable }
+func (errStore) Close() error             { return nil }
+
+// Queries are passed to the next plugin and updates fail if the store is unavailable.
+func TestStoreUnavailable(t *testing.T) {
+	tt := newTestTempTxt(t, recordDef{FQDN: "_acme-challenge.empty.example.com", Alias: "empty.example.com", Allowed: []string{"user1"}})
+	tt.Next = testHandler()
+	useStore(tt, errStore{})
+
+	req := new(dns.Msg)
+	req.SetQuestion("_acme-challenge.empty.example.com.", dns.TypeTXT)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := tt.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	assertRRs(t, 0, "answer", []string{`_acme-challenge.empty.example.com.	300	IN	TXT	"fallthrough"`}, rec.Msg.Answer)
+
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+	resp := sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "empty.example.com", "content": "a"}`, "user1")
+	resp.Body.Close()
+	assertStatus(http.StatusInternalServerError, resp, t)
+}
+
+// blockingStore is a memoryStore where Get waits until unblock is closed.
+type blockingStore struct {
+	*memoryStore
+	blocked chan struct{}
+	unblock chan struct{}
+}
+
+func (s *blockingStore) Get(fqdn string) (RecordState, error) {
+	select {
+	case s.blocked <- struct{}{}:
+	default:
+	}
+	<-s.unblock
+	return s.memoryStore.Get(fqdn)
+}
+
+// Records can be looked up while loading the store is waiting for it.
+func TestLoadStoreUnlocked(t *testing.T) {
+	const fqdn = "_acme-challenge.test1.example.com."
+	tt := newTestTempTxt(t, testRecordDef)
+	s := &blockingStore{memoryStore: newMemoryStore(), blocked: make(chan struct{}, 1), unblock: make(chan struct{})}
+	useStore(tt, s)
+	if err := tt.records[fqdn].add(Value{Txt: "a"}, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- tt.loadStore() }()
+	<-s.blocked
+
+	found := make(chan bool, 1)
+	go func() {
+		_, ok := tt.getRecord(fqdn)
+		found <- ok
+	}()
+	select {
+	case ok := <-found:
+		if !ok {
+			t.Errorf("Expected %q to be found", fqdn)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Looking up %q was blocked while loading the store", fqdn)
+	}
+
+	close(s.unblock)
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
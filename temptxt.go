@@ -2,29 +2,71 @@ package temptxt
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"io"
 	"net"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/dnssec"
+	"github.com/coredns/coredns/plugin/metrics"
 	"github.com/coredns/coredns/plugin/pkg/reuseport"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 )
 
 type TempTxt struct {
-	Next    plugin.Handler
+	Next plugin.Handler
+	// mtx protects records and aliases.
+	mtx     sync.RWMutex
 	records map[string]*Record
 	// aliases stores any aliases made with txt_alias.
 	// The Record should also be in records.
-	aliases    map[string]*Record
+	aliases map[string]*Record
+	// patterns create records for names matching a wildcard.
+	patterns []*pattern
+	// prefix and suffix are added to the FQDNs of txt records.
+	prefix     string
+	suffix     string
 	authHeader string
+	// trustedProxies are the networks authHeader is accepted from.
+	// The header is accepted from any address if it is empty.
+	trustedProxies []*net.IPNet
+
+	// ttl is the TTL of the TXT records.
+	ttl uint32
+	// soa is set when temptxt is authoritative for a zone.
+	soa *dns.SOA
+	// signer and keys are set when the zone is signed with DNSSEC.
+	signer *dnssec.Dnssec
+	keys   []*dnssec.DNSKEY
+
+	// nameservers are checked when waiting for an update to propagate.
+	nameservers []string
+	waitTimeout time.Duration
+
+	// peers is set when the records are replicated to other instances.
+	peers *peers
+
+	// recordsFile is set when records are also defined in a file.
+	recordsFile *recordsFile
+
+	// admins are the users that can use the admin API.
+	admins []*regexp.Regexp
+
+	// acmeDNS is set when the acme-dns compatible API is enabled.
+	acmeDNS *acmeDNS
+
+	// tsigKeys are the keys that can be used for RFC 2136 updates.
+	tsigKeys map[string]tsigKey
 
 	cleanInterval time.Duration
 	maxAge        time.Duration
@@ -32,36 +74,276 @@ type TempTxt struct {
 
 	listenAddr string
 	listener   net.Listener
+	// tlsConfig is set when the API is served over TLS.
+	tlsConfig *tls.Config
+	// auth is set when users are authenticated with passwords or tokens
+	// instead of authHeader.
+	auth *auth
+
+	// store holds the values of the records.
+	store Store
+
+	// auditLog is set when changes are written to an audit log.
+	auditLog *auditLog
+	// webhook is set when changes are sent to a webhook.
+	webhook *webhook
+
+	// maxValueLength is the maximum length of a value. 0 is defaultMaxValueLength.
+	maxValueLength int
+	// maxValues is the number of values a record can hold. 0 is unlimited.
+	maxValues int
+	// maxBytes is the total size of the values of all records. 0 is unlimited.
+	maxBytes int
+	// bytesMtx is held while checking maxBytes and adding a value.
+	bytesMtx sync.Mutex
+	// rateLimit is set when the number of update requests per user is limited.
+	rateLimit *rateLimiter
 }
 
 type Record struct {
-	content []string
-	// Store the alias for deletion
-	updated time.Time
+	// fqdn is the name the record is served at.
+	fqdn string
+	// store holds the values of the record.
+	store   Store
 	allowed []*regexp.Regexp
-	mtx     sync.RWMutex
+	// label is the wildcard label if the record was created from a pattern.
+	label string
+	// pattern is the pattern the record was created from, if any.
+	pattern *pattern
+	// size and oldest are the total length and the creation time of the oldest
+	// of the values last read from or written to the store.
+	size   int
+	oldest time.Time
+	mtx    sync.RWMutex
 }
 
 func (r *Record) IsAuthorized(user string) bool {
 	r.mtx.RLock()
 	defer r.mtx.RUnlock()
-	for _, r := range r.allowed {
-		if r.MatchString(user) {
+	for _, re := range r.allowed {
+		if matchUser(re, user, r.label) {
 			return true
 		}
 	}
 	return false
 }
 
+// state returns the values of the record from the store.
+func (r *Record) state() (RecordState, error) {
+	s, err := r.store.Get(r.fqdn)
+	if err == nil {
+		r.setSize(s)
+	}
+	return s, err
+}
+
+// update changes the state of the record in the store with fn.
+func (r *Record) update(fn func(RecordState) RecordState) (RecordState, error) {
+	s, err := r.store.Update(r.fqdn, fn)
+	if err != nil {
+		return s, err
+	}
+	r.setSize(s)
+	r.setValuesMetric(len(s.Values))
+	return s, nil
+}
+
+// setSize remembers the size and the oldest value of s for checking max_bytes.
+func (r *Record) setSize(s RecordState) {
+	size := 0
+	for _, v := range s.Values {
+		size += len(v.Txt)
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.size, r.oldest = size, oldestValue(s.Values)
+}
+
+// getSize returns the size and the oldest value from setSize.
+func (r *Record) getSize() (int, time.Time) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.size, r.oldest
+}
+
+// add appends v to the content of the record. The creation time of v is set.
+// If maxValues is not 0 and the record already holds that many values, errTooManyValues is returned.
+func (r *Record) add(v Value, maxValues int) error {
+	var limitErr error
+	_, err := r.update(func(s RecordState) RecordState {
+		limitErr = nil
+		if maxValues > 0 && len(s.Values) >= maxValues {
+			limitErr = errTooManyValues
+			return s
+		}
+		s.Updated = time.Now()
+		v.Created = s.Updated
+		s.Values = append(s.Values, v)
+		return s
+	})
+	if err != nil {
+		return err
+	}
+	return limitErr
+}
+
+// remove removes every occurrence of c from the content of the record.
+// It returns false if c was not found.
+func (r *Record) remove(c string) (bool, error) {
+	removed := false
+	_, err := r.update(func(s RecordState) RecordState {
+		values := make([]Value, 0, len(s.Values))
+		for _, v := range s.Values {
+			if v.Txt != c {
+				values = append(values, v)
+			}
+		}
+		removed = len(values) != len(s.Values)
+		if removed {
+			s.Values = values
+			s.Updated = time.Now()
+		}
+		return s
+	})
+	return removed, err
+}
+
+// clear removes all content from the record.
+func (r *Record) clear() error {
+	_, err := r.update(func(s RecordState) RecordState {
+		return RecordState{Updated: time.Now()}
+	})
+	return err
+}
+
+// expire removes the values that are older than maxAge.
+// If the record hasn't been updated within maxAge, all values are removed.
+// It returns the values removed and the number left.
+func (r *Record) expire(maxAge time.Duration) ([]string, int, error) {
+	s, err := r.state()
+	if err != nil || len(expireValues(s, maxAge)) == len(s.Values) {
+		return nil, len(s.Values), err
+	}
+
+	var removed []string
+	s, err = r.update(func(s RecordState) RecordState {
+		values := expireValues(s, maxAge)
+		// values keeps the order of s.Values
+		removed = removed[:0]
+		j := 0
+		for _, v := range s.Values {
+			if j < len(values) && values[j].Txt == v.Txt && values[j].Created.Equal(v.Created) {
+				j++
+				continue
+			}
+			removed = append(removed, v.Txt)
+		}
+		s.Values = values
+		return s
+	})
+	return removed, len(s.Values), err
+}
+
+// expireValues returns the values of s that are not older than maxAge.
+func expireValues(s RecordState, maxAge time.Duration) []Value {
+	if time.Since(s.Updated) > maxAge {
+		return nil
+	}
+	values := make([]Value, 0, len(s.Values))
+	for _, v := range s.Values {
+		if time.Since(v.Created) <= maxAge {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// answers returns a TXT RR for each value of the record.
+func (r *Record) answers(qname string, ttl uint32) ([]dns.RR, error) {
+	s, err := r.state()
+	if err != nil {
+		return nil, err
+	}
+	answers := make([]dns.RR, 0, len(s.Values))
+	for _, v := range s.Values {
+		txt := new(dns.TXT)
+		txt.Hdr = dns.RR_Header{Name: qname, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl}
+		txt.Txt = v.txtStrings()
+		answers = append(answers, txt)
+	}
+	return answers, nil
+}
+
+// setValuesMetric sets the values metric for the record to n.
+func (r *Record) setValuesMetric(n int) {
+	recordValues.WithLabelValues(r.fqdn).Set(float64(n))
+}
+
+// values returns the content of the record.
+func (r *Record) values() ([]string, error) {
+	s, err := r.state()
+	if err != nil {
+		return nil, err
+	}
+	return s.txts(), nil
+}
+
+// Actions for UpdateBody.
+const (
+	// ActionAdd appends the content. The record is cleared if the content is empty.
+	ActionAdd = "add"
+	// ActionRemove removes only the given content.
+	ActionRemove = "remove"
+	// ActionClear removes all content.
+	ActionClear = "clear"
+)
+
+// actionExpire is the action of audit entries and webhook events
+// for values removed by the cleaner.
+const actionExpire = "expire"
+
 type UpdateBody struct {
 	FQDN    string `json:"fqdn"`
 	Content string `json:"content"`
+	// Strings are the character-strings of the value instead of Content.
+	// Each one can be up to 255 bytes.
+	Strings []string `json:"strings,omitempty"`
+	// Action is one of ActionAdd (the default), ActionRemove or ActionClear.
+	Action string `json:"action,omitempty"`
+	// Wait for the change to be served by all nameservers before returning.
+	Wait bool `json:"wait,omitempty"`
 }
 
 func (tt *TempTxt) Name() string {
 	return "temptxt"
 }
 
+func (tt *TempTxt) getRecord(name string) (*Record, bool) {
+	tt.mtx.RLock()
+	defer tt.mtx.RUnlock()
+	r, ok := tt.records[name]
+	return r, ok
+}
+
+// allRecords returns all records. Getting the values of a record can be slow
+// with some stores, so they should be read without holding tt.mtx.
+func (tt *TempTxt) allRecords() []*Record {
+	tt.mtx.RLock()
+	defer tt.mtx.RUnlock()
+	records := make([]*Record, 0, len(tt.records))
+	for _, r := range tt.records {
+		records = append(records, r)
+	}
+	return records
+}
+
+func (tt *TempTxt) getAlias(name string) (*Record, bool) {
+	tt.mtx.RLock()
+	defer tt.mtx.RUnlock()
+	r, ok := tt.aliases[name]
+	return r, ok
+}
+
 func (tt *TempTxt) setModified() {
 	atomic.StoreUint32(&tt.modified, 1)
 }
@@ -71,44 +353,60 @@ func (tt *TempTxt) clearModified() bool {
 }
 
 func (tt *TempTxt) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	if r.Opcode == dns.OpcodeUpdate {
+		return tt.serveUpdate(ctx, w, r)
+	}
+
 	state := request.Request{W: w, Req: r}
 
+	// ToLower for DNS capitalization randomiztion
+	name := strings.ToLower(state.QName())
+
+	if tt.soa != nil && dns.IsSubDomain(tt.soa.Hdr.Name, name) {
+		return tt.serveZone(ctx, state, name)
+	}
+
 	if state.QType() != dns.TypeTXT {
 		return plugin.NextOrFailure(tt.Name(), tt.Next, ctx, w, r)
 	}
 
-	name := state.QName()
-
-	// ToLower for DNS capitalization randomiztion
-	record, ok := tt.records[strings.ToLower(name)]
+	record, ok := tt.servedRecord(name)
 
 	if !ok {
 		return plugin.NextOrFailure(tt.Name(), tt.Next, ctx, w, r)
 	}
 
-	answers := []dns.RR{}
-	record.mtx.RLock()
-	if len(record.content) == 0 {
-		record.mtx.RUnlock()
+	m, err := tt.txtAnswer(r, record)
+	if err != nil {
+		log.Errorf("Error getting values of %q: %v", record.fqdn, err)
+		queryCount.WithLabelValues(metrics.WithServer(ctx), record.fqdn, resultNext).Inc()
 		return plugin.NextOrFailure(tt.Name(), tt.Next, ctx, w, r)
 	}
-	for _, c := range record.content {
-		txt := new(dns.TXT)
-		txt.Hdr = dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeTXT, Class: dns.ClassINET}
-		txt.Txt = []string{c}
-		answers = append(answers, txt)
+	if m == nil {
+		queryCount.WithLabelValues(metrics.WithServer(ctx), record.fqdn, resultNext).Inc()
+		return plugin.NextOrFailure(tt.Name(), tt.Next, ctx, w, r)
 	}
-	record.mtx.RUnlock()
 
+	w.WriteMsg(m)
+
+	queryCount.WithLabelValues(metrics.WithServer(ctx), record.fqdn, resultAnswered).Inc()
+
+	return dns.RcodeSuccess, nil
+}
+
+// txtAnswer returns the answer to the TXT query r for record
+// or nil if the record has no values.
+func (tt *TempTxt) txtAnswer(r *dns.Msg, record *Record) (*dns.Msg, error) {
+	answers, err := record.answers(r.Question[0].Name, tt.ttl)
+	if err != nil || len(answers) == 0 {
+		return nil, err
+	}
 	m := new(dns.Msg)
 	m.SetReply(r)
 
 	m.Authoritative = true
 	m.Answer = answers
-
-	w.WriteMsg(m)
-
-	return dns.RcodeSuccess, nil
+	return m, nil
 }
 
 func (tt *TempTxt) OnStartup() error {
@@ -117,17 +415,37 @@ func (tt *TempTxt) OnStartup() error {
 	if err != nil {
 		return err
 	}
+	if tt.tlsConfig != nil {
+		tt.listener = tls.NewListener(tt.listener, tt.tlsConfig)
+	}
+
+	go func() { http.Serve(tt.listener, tt.handler()) }()
+
+	return nil
+}
 
+// handler returns the handler for the HTTP API.
+func (tt *TempTxt) handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/update", tt.updateHandler)
+	mux.HandleFunc("/records/", tt.recordHandler)
+	if tt.acmeDNS != nil {
+		mux.HandleFunc("/register", tt.acmeDNSRegisterHandler)
+	}
+	if len(tt.admins) > 0 {
+		mux.HandleFunc("/admin/records", tt.adminRecordsHandler)
+		mux.HandleFunc("/admin/records/", tt.adminRecordHandler)
+	}
+	if tt.peers != nil {
+		mux.HandleFunc("/peer/sync", tt.peerHandler)
+	}
+	mux.HandleFunc("/present", tt.legoPresentHandler)
+	mux.HandleFunc("/cleanup", tt.legoCleanupHandler)
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		io.WriteString(w, http.StatusText(http.StatusOK))
 	})
-
-	go func() { http.Serve(tt.listener, mux) }()
-
-	return nil
+	return mux
 }
 
 func (tt *TempTxt) OnFinalShutdown() error {
@@ -137,15 +455,46 @@ func (tt *TempTxt) OnFinalShutdown() error {
 	return nil
 }
 
+// statusRecorder records the status code written to a http.ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
 func (tt *TempTxt) updateHandler(w http.ResponseWriter, r *http.Request) {
+	sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	entry := auditEntry{Source: auditSourceAPI, RemoteAddr: r.RemoteAddr}
+	defer func() {
+		updateCount.WithLabelValues(strconv.Itoa(sr.status)).Inc()
+		entry.Status = sr.status
+		tt.audit(entry)
+	}()
+	w = sr
+
+	// acme-dns clients use POST
+	if r.Method == http.MethodPost && tt.acmeDNS != nil {
+		entry.Source = auditSourceAcmeDNS
+		tt.acmeDNSUpdateHandler(w, r, &entry)
+		return
+	}
+
 	if r.Method != http.MethodPut {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
 
-	user := r.Header.Get(tt.authHeader)
-	if user == "" {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	user, ok := tt.getUser(w, r)
+	if !ok {
+		return
+	}
+	entry.User = user
+
+	if !tt.checkRate(w, user) {
 		return
 	}
 
@@ -165,53 +514,203 @@ func (tt *TempTxt) updateHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		ub.FQDN = r.PostFormValue("fqdn")
 		ub.Content = r.PostFormValue("content")
+		ub.Strings = r.PostForm["strings"]
+		ub.Action = r.PostFormValue("action")
+		ub.Wait = r.PostFormValue("wait") == "true"
 	default:
 		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
 		return
 	}
+	entry.FQDN, entry.Action, entry.Value = ub.FQDN, ub.Action, ub.Content
 
 	if ub.FQDN == "" {
 		http.Error(w, "fqdn cannot be empty", http.StatusBadRequest)
 		return
 	}
 
-	if len(ub.Content) > 255 {
+	if len(ub.Strings) > 0 {
+		if ub.Content != "" {
+			http.Error(w, "content and strings cannot both be set", http.StatusBadRequest)
+			return
+		}
+		for _, str := range ub.Strings {
+			if len(str) > maxStringLength {
+				http.Error(w, "strings cannot be longer than 255 bytes", http.StatusBadRequest)
+				return
+			}
+		}
+		ub.Content = strings.Join(ub.Strings, "")
+		entry.Value = ub.Content
+		if ub.Content == "" {
+			http.Error(w, "strings cannot be empty", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if len(ub.Content) > tt.valueLimit() {
 		http.Error(w, "content is too long", http.StatusBadRequest)
 		return
 	}
 
+	switch ub.Action {
+	case "", ActionAdd, ActionClear:
+	case ActionRemove:
+		if ub.Content == "" {
+			http.Error(w, "content cannot be empty", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "invalid action", http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Query().Get("wait") == "true" {
+		ub.Wait = true
+	}
+
 	// Normalize
 	ub.FQDN = dns.Fqdn(ub.FQDN)
 
-	record, ok := tt.aliases[ub.FQDN]
+	entry.FQDN = ub.FQDN
+	switch {
+	case ub.Action == ActionRemove:
+	case ub.Action == ActionClear || ub.Content == "":
+		entry.Action = ActionClear
+	default:
+		entry.Action = ActionAdd
+	}
 
-	if !ok {
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	record := tt.aliasOrPattern(ub.FQDN, user)
+	if record != nil {
+		entry.Record = record.fqdn
+	}
+	if !authorize(w, record, ub.FQDN, user) {
 		return
 	}
 
-	if !record.IsAuthorized(user) {
-		log.Errorf("Unauthorized update for %q from user %q", ub.FQDN, user)
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	var done func([]string) bool
+	var err error
+	changed := true
+	switch entry.Action {
+	case ActionRemove:
+		changed, err = record.remove(ub.Content)
+		done = notHasValue(ub.Content)
+	case ActionClear:
+		err = record.clear()
+		done = noValues
+	default:
+		err = tt.addValue(record, Value{Txt: ub.Content, Strings: ub.Strings})
+		done = hasValue(ub.Content)
+	}
+	if writeLimitError(w, err) {
+		log.Errorf("Limit exceeded updating %q: %v", ub.FQDN, err)
+		return
+	} else if err != nil {
+		log.Errorf("Error updating %q: %v", ub.FQDN, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	record.mtx.Lock()
-	if ub.Content == "" {
-		record.content = nil
-	} else {
-		record.content = append(record.content, ub.Content)
+	if changed {
+		tt.setModified()
+		tt.replicate(record)
+		tt.notify(webhookEvent{Action: entry.Action, FQDN: ub.FQDN, Record: record.fqdn, User: user, Value: ub.Content})
 	}
-	record.updated = time.Now()
-	record.mtx.Unlock()
-
-	tt.setModified()
 
 	log.Infof("Received update for %q from user %q", ub.FQDN, user)
 
+	if ub.Wait {
+		if err := tt.waitForPropagation(r.Context(), record, done); err != nil {
+			log.Errorf("Error waiting for %q: %v", ub.FQDN, err)
+			http.Error(w, err.Error(), http.StatusGatewayTimeout)
+			return
+		}
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// getUser returns the authenticated user of the request.
+// If there is no user, an error response is written.
+func (tt *TempTxt) getUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user := tt.requestUser(r)
+	if user == "" {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return "", false
+	}
+	return user, true
+}
+
+// requestUser returns the authenticated user of the request or "" if there is none.
+// When client certificates are verified, the user comes from the certificate.
+// Then the auth block is used if configured. Otherwise it comes from the auth header.
+func (tt *TempTxt) requestUser(r *http.Request) string {
+	if tt.tlsConfig != nil && tt.tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return ""
+		}
+		return certUser(r.TLS.VerifiedChains[0][0])
+	}
+	if tt.auth != nil {
+		return tt.auth.user(r)
+	}
+	if !tt.isTrustedProxy(r) {
+		return ""
+	}
+	return r.Header.Get(tt.authHeader)
+}
+
+// isTrustedProxy returns true if the request came from one of the trusted proxies.
+func (tt *TempTxt) isTrustedProxy(r *http.Request) bool {
+	if len(tt.trustedProxies) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range tt.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// certUser returns the subject CN of cert. If the CN is empty,
+// the first DNS name or email address SAN is used.
+func certUser(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+// authorize checks that record exists and that user may update it.
+// If not, an error response is written.
+func authorize(w http.ResponseWriter, record *Record, fqdn string, user string) bool {
+	if record == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return false
+	}
+
+	if !record.IsAuthorized(user) {
+		log.Errorf("Unauthorized update for %q from user %q", fqdn, user)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 // Clean old records from the zone
 func (tt *TempTxt) Run(ctx context.Context) {
 	go func() {
@@ -221,12 +720,29 @@ func (tt *TempTxt) Run(ctx context.Context) {
 				return
 			case <-time.After(tt.cleanInterval):
 				if tt.clearModified() {
-					for _, v := range tt.records {
-						v.mtx.Lock()
-						if time.Since(v.updated) > tt.maxAge && len(v.content) > 0 {
-							v.content = nil
+					remaining := false
+					for _, v := range tt.allRecords() {
+						removed, left, err := v.expire(tt.maxAge)
+						if err != nil {
+							log.Errorf("Error cleaning %q: %v", v.fqdn, err)
+							// Try again next time
+							remaining = true
+							continue
+						}
+						if len(removed) > 0 {
+							cleanedCount.WithLabelValues(v.fqdn).Add(float64(len(removed)))
+							tt.audit(auditEntry{Source: auditSourceClean, Record: v.fqdn, Action: actionExpire, Removed: len(removed)})
+							for _, txt := range removed {
+								tt.notify(webhookEvent{Action: actionExpire, Record: v.fqdn, Value: txt})
+							}
 						}
-						v.mtx.Unlock()
+						if left > 0 {
+							remaining = true
+						}
+					}
+					// Values that haven't expired yet need to be checked again
+					if remaining {
+						tt.setModified()
 					}
 				}
 			}
@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"reflect"
 	"regexp"
 	"strings"
 	"testing"
@@ -24,6 +27,29 @@ var (
 	client    = http.Client{}
 )
 
+// testRecordDef is the record used by most tests.
+// It is served at _acme-challenge.test1.example.com. and user1 can update it as test1.example.com.
+var testRecordDef = recordDef{FQDN: "_acme-challenge.test1.example.com", Alias: "test1.example.com", Allowed: []string{"user1"}}
+
+// newTestTempTxt returns a TempTxt using a memory store with the records for defs.
+// The definitions are added without a PREFIX or SUFFIX.
+func newTestTempTxt(t *testing.T, defs ...recordDef) *TempTxt {
+	t.Helper()
+	tt := &TempTxt{
+		authHeader: defaultAuthHeader,
+		maxAge:     time.Minute,
+		records:    make(map[string]*Record),
+		aliases:    make(map[string]*Record),
+		store:      newMemoryStore(),
+	}
+	for _, def := range defs {
+		if err := tt.addRecordLocked(def); err != nil {
+			t.Fatalf("Error adding %q: %v", def.FQDN, err)
+		}
+	}
+	return tt
+}
+
 func testHandler() test.HandlerFunc {
 	return func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 		state := request.Request{W: w, Req: r}
@@ -49,17 +75,21 @@ func TestMain(m *testing.M) {
 	tt.aliases = map[string]*Record{
 		"test1.example.com.": {allowed: []*regexp.Regexp{regexp.MustCompile("^test1[0-9]$")}},
 		// Used in TestServeDNS. Do not modify content.
-		"test2.example.com.": {content: []string{"test2"}},
+		"test2.example.com.": {},
 		// Used in TestUpdateAndQuery.
-		"test3.example.com.": {content: []string{}, allowed: []*regexp.Regexp{regexp.MustCompile("^test13$")}},
+		"test3.example.com.": {allowed: []*regexp.Regexp{regexp.MustCompile("^test13$")}},
 		// Used in TestUpdateAndQueryAlias
-		"test4-alias.example.com.": {content: nil, allowed: []*regexp.Regexp{regexp.MustCompile("test14")}},
+		"test4-alias.example.com.": {allowed: []*regexp.Regexp{regexp.MustCompile("test14")}},
 		// Used in TestUPdateAndQueryForm
-		"test5.example.com.": {content: []string{}, allowed: []*regexp.Regexp{regexp.MustCompile("^test15$")}},
+		"test5.example.com.": {allowed: []*regexp.Regexp{regexp.MustCompile("^test15$")}},
 		// Used in TestUpdateAndQueryAliasMultiple
-		"test6-alias.example.com.": {content: []string{}, allowed: []*regexp.Regexp{regexp.MustCompile("^test16$")}},
+		"test6-alias.example.com.": {allowed: []*regexp.Regexp{regexp.MustCompile("^test16$")}},
 		// Used in TestUpdateAndQueryMultiple
-		"test7.example.com.": {content: []string{}, allowed: []*regexp.Regexp{regexp.MustCompile("^test17$")}},
+		"test7.example.com.": {allowed: []*regexp.Regexp{regexp.MustCompile("^test17$")}},
+		// Used in TestUpdateRemove and TestUpdateInvalidAction
+		"test9.example.com.": {allowed: []*regexp.Regexp{regexp.MustCompile("^test19$")}},
+		// Used in TestLego*
+		"test8.example.com.": {allowed: []*regexp.Regexp{regexp.MustCompile("^test18$")}},
 		"empty.example.com.": {},
 	}
 
@@ -73,6 +103,9 @@ func TestMain(m *testing.M) {
 			tt.records["_acme-challenge."+k] = v
 		}
 	}
+	useStore(&tt, &memoryStore{states: map[string]RecordState{
+		"_acme-challenge.test2.example.com.": {Values: []Value{{Txt: "test2"}}},
+	}})
 
 	if err := tt.OnStartup(); err != nil {
 		log.Errorf("Error starting acme proxy server: %v\n", err)
@@ -297,7 +330,7 @@ func TestForbidden(t *testing.T) {
 }
 
 func TestContentTooLong(t *testing.T) {
-	content := strings.Repeat("a", 256)
+	content := strings.Repeat("a", defaultMaxValueLength+1)
 	req, err := http.NewRequest("PUT", updateUrl, bytes.NewBuffer([]byte(`{"fqdn":"test1.example.com.", "content": "`+content+`"}`)))
 	if err != nil {
 		t.Fatalf("Error creating request: %v", err)
@@ -531,10 +564,11 @@ func TestCleanModified(t *testing.T) {
 	tt := TempTxt{Next: testHandler(), maxAge: 4 * time.Minute, cleanInterval: 10 * time.Millisecond}
 
 	updated := time.Now().Add(time.Duration(-5 * time.Minute))
-	tt.records = map[string]*Record{
-		"test-clean1.example.com.": {content: []string{"some data"}, updated: updated},
-		"test-clean2.example.com.": {content: []string{"other data"}, updated: updated},
-	}
+	tt.records = map[string]*Record{"test-clean1.example.com.": {}, "test-clean2.example.com.": {}}
+	useStore(&tt, &memoryStore{states: map[string]RecordState{
+		"test-clean1.example.com.": {Values: []Value{{Txt: "some data"}}, Updated: updated},
+		"test-clean2.example.com.": {Values: []Value{{Txt: "other data"}}, Updated: updated},
+	}})
 	tt.setModified()
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -543,7 +577,7 @@ func TestCleanModified(t *testing.T) {
 	cancel()
 
 	for k, v := range tt.records {
-		if l := len(v.content); l != 0 {
+		if l := len(valuesOf(t, v)); l != 0 {
 			t.Errorf("[%s] Expected length 0, but got %d", k, l)
 		}
 	}
@@ -553,26 +587,341 @@ func TestCleanModified(t *testing.T) {
 	}
 }
 
+// Each value should expire on its own.
+func TestCleanPerValue(t *testing.T) {
+	tt := TempTxt{Next: testHandler(), maxAge: 4 * time.Minute, cleanInterval: 10 * time.Millisecond}
+
+	old := time.Now().Add(-5 * time.Minute)
+	recent := time.Now().Add(-1 * time.Minute)
+	tt.records = map[string]*Record{"test-clean1.example.com.": {}}
+	useStore(&tt, &memoryStore{states: map[string]RecordState{
+		"test-clean1.example.com.": {Values: []Value{{Txt: "old", Created: old}, {Txt: "recent", Created: recent}}, Updated: recent},
+	}})
+	tt.setModified()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tt.Run(ctx)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	if want := []string{"recent"}; !reflect.DeepEqual(valuesOf(t, tt.records["test-clean1.example.com."]), want) {
+		t.Errorf("Expected content %v, got %v", want, valuesOf(t, tt.records["test-clean1.example.com."]))
+	}
+
+	// The remaining value still needs to be cleaned later
+	if !tt.clearModified() {
+		t.Errorf("Expected modified to be set")
+	}
+}
+
+func TestRecordExpire(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		state   RecordState
+		want    []string
+		removed int
+	}{
+		{
+			state:   RecordState{},
+			want:    []string{},
+			removed: 0,
+		},
+		{
+			state: RecordState{
+				Values:  []Value{{Txt: "a", Created: now.Add(-5 * time.Minute)}, {Txt: "b", Created: now}},
+				Updated: now,
+			},
+			want:    []string{"b"},
+			removed: 1,
+		},
+		// Record level expiry
+		{
+			state:   RecordState{Values: []Value{{Txt: "a", Created: now}}, Updated: now.Add(-5 * time.Minute)},
+			want:    []string{},
+			removed: 1,
+		},
+	}
+
+	for i, tc := range tests {
+		record := &Record{fqdn: "test.example.com.", store: &memoryStore{states: map[string]RecordState{"test.example.com.": tc.state}}}
+		removed, left, err := record.expire(4 * time.Minute)
+		if err != nil {
+			t.Fatalf("[%d] Unexpected error: %v", i, err)
+		}
+		if len(removed) != tc.removed {
+			t.Errorf("[%d] Expected %d removed, got %v", i, tc.removed, removed)
+		}
+		if left != len(tc.want) {
+			t.Errorf("[%d] Expected %d left, got %d", i, len(tc.want), left)
+		}
+		if have := valuesOf(t, record); !reflect.DeepEqual(have, tc.want) {
+			t.Errorf("[%d] Expected content %v, got %v", i, tc.want, have)
+		}
+	}
+}
+
 // Nothing should be cleared because the modified flag hasn't been set.
 func TestCleanNotModified(t *testing.T) {
 	tt := TempTxt{Next: testHandler(), maxAge: 4 * time.Minute, cleanInterval: 10 * time.Millisecond}
 
 	updated := time.Now().Add(time.Duration(-5 * time.Minute))
-	tt.records = map[string]*Record{
-		"test-clean1.example.com.": {content: []string{"data"}, updated: updated},
-		"test-clean2.example.com.": {content: []string{"data", "data2"}, updated: updated},
-	}
+	tt.records = map[string]*Record{"test-clean1.example.com.": {}, "test-clean2.example.com.": {}}
+	useStore(&tt, &memoryStore{states: map[string]RecordState{
+		"test-clean1.example.com.": {Values: []Value{{Txt: "data"}}, Updated: updated},
+		"test-clean2.example.com.": {Values: []Value{{Txt: "data"}, {Txt: "data2"}}, Updated: updated},
+	}})
 
 	ctx, cancel := context.WithCancel(context.Background())
 	tt.Run(ctx)
 	time.Sleep(50 * time.Millisecond)
 	cancel()
 
-	wantLen := 1
+	wantLen := map[string]int{"test-clean1.example.com.": 1, "test-clean2.example.com.": 2}
 	for k, v := range tt.records {
-		if l := len(v.content); l != wantLen {
-			t.Errorf(`[%s] wanted %d item(s) in content but got %d: %v`, k, wantLen, l, v.content)
+		if l := len(valuesOf(t, v)); l != wantLen[k] {
+			t.Errorf(`[%s] wanted %d item(s) in content but got %d: %v`, k, wantLen[k], l, valuesOf(t, v))
+		}
+	}
+}
+
+func putUpdate(t *testing.T, body string, user string) *http.Response {
+	t.Helper()
+	return sendRequest(t, "PUT", updateUrl, body, user)
+}
+
+// sendRequest sends a request with a JSON body as user.
+func sendRequest(t *testing.T, method string, url string, body string, user string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Forwarded-User", user)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	return resp
+}
+
+func TestUpdateInvalidAction(t *testing.T) {
+	resp := putUpdate(t, `{"fqdn":"test9.example.com.", "content": "a", "action": "invalid"}`, "test19")
+	assertStatus(http.StatusBadRequest, resp, t)
+
+	// remove requires content
+	resp = putUpdate(t, `{"fqdn":"test9.example.com.", "action": "remove"}`, "test19")
+	assertStatus(http.StatusBadRequest, resp, t)
+}
+
+func TestUpdateRemove(t *testing.T) {
+	record := tt.records["_acme-challenge.test9.example.com."]
+
+	for _, c := range []string{"value1", "value2", "value3"} {
+		resp := putUpdate(t, `{"fqdn":"test9.example.com.", "content": "`+c+`"}`, "test19")
+		assertStatus(http.StatusNoContent, resp, t)
+	}
+
+	resp := putUpdate(t, `{"fqdn":"test9.example.com.", "content": "value2", "action": "remove"}`, "test19")
+	assertStatus(http.StatusNoContent, resp, t)
+
+	data := url.Values{}
+	data.Set("fqdn", "test9.example.com.")
+	data.Set("content", "value1")
+	data.Set("action", "remove")
+	req, err := http.NewRequest("PUT", updateUrl, strings.NewReader(data.Encode()))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("X-Forwarded-User", "test19")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	assertStatus(http.StatusNoContent, resp, t)
+
+	if want := []string{"value3"}; !reflect.DeepEqual(valuesOf(t, record), want) {
+		t.Errorf("Expected content %v, got %v", want, valuesOf(t, record))
+	}
+
+	resp = putUpdate(t, `{"fqdn":"test9.example.com.", "content": "value3", "action": "clear"}`, "test19")
+	assertStatus(http.StatusNoContent, resp, t)
+
+	if l := len(valuesOf(t, record)); l != 0 {
+		t.Errorf("Expected length 0, but got %d", l)
+	}
+}
+
+func TestTrustedProxiesUser(t *testing.T) {
+	tt := TempTxt{authHeader: defaultAuthHeader}
+	for _, n := range []string{"10.0.0.0/8", "2001:db8::/32"} {
+		_, ipNet, _ := net.ParseCIDR(n)
+		tt.trustedProxies = append(tt.trustedProxies, ipNet)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		want       string
+	}{
+		{remoteAddr: "10.1.2.3:1234", want: "user1"},
+		{remoteAddr: "[2001:db8::1]:1234", want: "user1"},
+		{remoteAddr: "192.0.2.1:1234", want: ""},
+		{remoteAddr: "[2001:db9::1]:1234", want: ""},
+		{remoteAddr: "invalid", want: ""},
+	}
+
+	for i, tc := range tests {
+		r, err := http.NewRequest("PUT", "/update", nil)
+		if err != nil {
+			t.Fatalf("[%d] Error creating request: %v", i, err)
+		}
+		r.RemoteAddr = tc.remoteAddr
+		r.Header.Set(defaultAuthHeader, "user1")
+		if have := tt.requestUser(r); have != tc.want {
+			t.Errorf("[%d] Expected user %q, got %q", i, tc.want, have)
+		}
+	}
+}
+
+// Requests from untrusted addresses should be rejected.
+func TestTrustedProxiesUnauthorized(t *testing.T) {
+	tt := TempTxt{authHeader: defaultAuthHeader, store: newMemoryStore()}
+	// httptest.NewRequest uses 192.0.2.1 as the remote address
+	_, n, _ := net.ParseCIDR("198.51.100.0/24")
+	tt.trustedProxies = []*net.IPNet{n}
+
+	req := httptest.NewRequest("PUT", "/update", strings.NewReader(`{"fqdn": "test1.example.com.", "content": "a"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(defaultAuthHeader, "test10")
+	rec := httptest.NewRecorder()
+	tt.updateHandler(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+}
+
+// Answers with many values should fit the client's buffer size and
+// be truncated over UDP so that the client retries over TCP.
+func TestServeDNSLargeAnswer(t *testing.T) {
+	const fqdn = "_acme-challenge.large.example.com."
+	const values = 20
+	tt := newTestTempTxt(t, recordDef{FQDN: fqdn, Allowed: []string{"user1"}})
+	tt.Next = testHandler()
+	r := tt.records[fqdn]
+	for i := 0; i < values; i++ {
+		if err := r.add(Value{Txt: fmt.Sprintf("%03d", i) + strings.Repeat("a", 252)}, 0); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		tcp     bool
+		udpSize uint16
+		// wantTC is set if the answer should be truncated.
+		wantTC bool
+	}{
+		{udpSize: 0, wantTC: true},
+		{udpSize: 1232, wantTC: true},
+		{udpSize: 4096, wantTC: true},
+		{udpSize: 65535},
+		{tcp: true},
+		{tcp: true, udpSize: 1232},
+	}
+
+	for i, tc := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(fqdn, dns.TypeTXT)
+		if tc.udpSize > 0 {
+			req.SetEdns0(tc.udpSize, false)
+		}
+		rec := dnstest.NewRecorder(&test.ResponseWriter{TCP: tc.tcp})
+		// CoreDNS wraps the writer of every query in a ScrubWriter
+		if _, err := tt.ServeDNS(context.Background(), request.NewScrubWriter(req, rec), req); err != nil {
+			t.Fatalf("[%d] Unexpected error %v", i, err)
+		}
+
+		if rec.Msg.Truncated != tc.wantTC {
+			t.Errorf("[%d] Expected TC %v, got %v", i, tc.wantTC, rec.Msg.Truncated)
+		}
+		if !tc.wantTC && len(rec.Msg.Answer) != values {
+			t.Errorf("[%d] Expected %d answers, got %d", i, values, len(rec.Msg.Answer))
+		}
+		if tc.wantTC && len(rec.Msg.Answer) >= values {
+			t.Errorf("[%d] Expected fewer than %d answers, got %d", i, values, len(rec.Msg.Answer))
+		}
+
+		size := dns.MinMsgSize
+		if tc.udpSize > dns.MinMsgSize {
+			size = int(tc.udpSize)
+		}
+		if !tc.tcp && rec.Msg.Len() > size {
+			t.Errorf("[%d] Expected at most %d bytes, got %d", i, size, rec.Msg.Len())
+		}
+
+		opt := rec.Msg.IsEdns0()
+		if tc.udpSize == 0 && opt != nil {
+			t.Errorf("[%d] Expected no OPT record, got %v", i, opt)
+		}
+		if tc.udpSize > 0 && (opt == nil || opt.UDPSize() != tc.udpSize) {
+			t.Errorf("[%d] Expected an OPT record with size %d, got %v", i, tc.udpSize, opt)
+		}
+	}
+}
+
+// Values longer than 255 bytes should be split into character-strings
+// unless the strings are given explicitly.
+func TestUpdateLongValue(t *testing.T) {
+	const fqdn = "_acme-challenge.long.example.com."
+	tt := newTestTempTxt(t, recordDef{FQDN: fqdn, Alias: "long.example.com", Allowed: []string{"user1"}})
+	tt.Next = testHandler()
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	long := strings.Repeat("a", 255) + strings.Repeat("b", 100)
+	for _, body := range []string{
+		`{"fqdn": "long.example.com", "content": "` + long + `"}`,
+		`{"fqdn": "long.example.com", "strings": ["v=DKIM1; k=rsa; ", "p=abc"]}`,
+	} {
+		resp := sendRequest(t, "PUT", s.URL+"/update", body, "user1")
+		resp.Body.Close()
+		assertStatus(http.StatusNoContent, resp, t)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(fqdn, dns.TypeTXT)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{TCP: true})
+	if _, err := tt.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	assertRRs(t, 0, "answer", []string{
+		fmt.Sprintf("%s\t0\tIN\tTXT\t%q %q", fqdn, strings.Repeat("a", 255), strings.Repeat("b", 100)),
+		fqdn + "\t0\tIN\tTXT\t\"v=DKIM1; k=rsa; \" \"p=abc\"",
+	}, rec.Msg.Answer)
+
+	// Values with strings are removed by their joined content
+	resp := sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "long.example.com", "strings": ["v=DKIM1; k=rsa; p=abc"], "action": "remove"}`, "user1")
+	resp.Body.Close()
+	assertStatus(http.StatusNoContent, resp, t)
+	if values := valuesOf(t, tt.records[fqdn]); !reflect.DeepEqual(values, []string{long}) {
+		t.Errorf("Expected values %v, got %v", []string{long}, values)
+	}
+}
+
+func TestUpdateInvalidStrings(t *testing.T) {
+	tt := &TempTxt{authHeader: defaultAuthHeader}
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	for i, body := range []string{
+		`{"fqdn": "long.example.com", "content": "a", "strings": ["b"]}`,
+		`{"fqdn": "long.example.com", "strings": ["` + strings.Repeat("a", 256) + `"]}`,
+		`{"fqdn": "long.example.com", "strings": ["", ""]}`,
+	} {
+		resp := sendRequest(t, "PUT", s.URL+"/update", body, "user1")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("[%d] Expected status %d, got %d", i, http.StatusBadRequest, resp.StatusCode)
 		}
-		wantLen++
 	}
 }
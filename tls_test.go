@@ -0,0 +1,240 @@
+package temptxt
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert creates a certificate from template signed by parent.
+// If parent is nil, the certificate is self signed.
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Error parsing certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error marshalling key: %v", err)
+	}
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatalf("Error loading key pair: %v", err)
+	}
+	return cert
+}
+
+func writeFile(t *testing.T, dir string, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	return path
+}
+
+func TestCertUser(t *testing.T) {
+	tests := []struct {
+		cert *x509.Certificate
+		want string
+	}{
+		{cert: &x509.Certificate{Subject: pkix.Name{CommonName: "cn"}, DNSNames: []string{"dns"}}, want: "cn"},
+		{cert: &x509.Certificate{DNSNames: []string{"dns"}, EmailAddresses: []string{"email"}}, want: "dns"},
+		{cert: &x509.Certificate{EmailAddresses: []string{"email"}}, want: "email"},
+		{cert: &x509.Certificate{}, want: ""},
+	}
+	for i, tc := range tests {
+		if have := certUser(tc.cert); have != tc.want {
+			t.Errorf("[%d] Expected %q, got %q", i, tc.want, have)
+		}
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "ca"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil)
+	server := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	client1 := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "user1"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	client2 := newTestCert(t, &x509.Certificate{
+		DNSNames:    []string{"user2"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	other := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "user1"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, nil)
+
+	dir := t.TempDir()
+	certFile := writeFile(t, dir, "server.crt", server.certPEM)
+	keyFile := writeFile(t, dir, "server.key", server.keyPEM)
+	caFile := writeFile(t, dir, "ca.crt", ca.certPEM)
+
+	c := caddy.NewTestController("dns", `temptxt {
+	tls `+certFile+` `+keyFile+` `+caFile+`
+	listen 127.0.0.1:0
+	txt test.example.com user1 user2
+}`)
+	tt, err := parseConfig(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := tt.OnStartup(); err != nil {
+		t.Fatalf("Error starting server: %v", err)
+	}
+	defer tt.OnFinalShutdown()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tests := []struct {
+		cert *testCert
+		user string
+		want int
+	}{
+		{cert: client1, want: http.StatusNoContent},
+		{cert: client2, want: http.StatusNoContent},
+		// The header should be ignored
+		{cert: client1, user: "user3", want: http.StatusNoContent},
+		{want: -1},
+		{cert: other, want: -1},
+	}
+
+	for i, tc := range tests {
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if tc.cert != nil {
+			tlsConfig.Certificates = []tls.Certificate{tc.cert.tlsCertificate(t)}
+		}
+		client := http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+
+		req, err := http.NewRequest("PUT", "https://"+tt.listener.Addr().String()+"/update", bytes.NewBufferString(`{"fqdn": "test.example.com", "content": "a"}`))
+		if err != nil {
+			t.Fatalf("[%d] Error creating request: %v", i, err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if tc.user != "" {
+			req.Header.Set("X-Forwarded-User", tc.user)
+		}
+		resp, err := client.Do(req)
+		if tc.want == -1 {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("[%d] Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%d] Error sending request: %v", i, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("[%d] Expected status code %d, got %d", i, tc.want, resp.StatusCode)
+		}
+	}
+}
+
+// Without a CA the auth header should be used.
+func TestTLSAuthHeader(t *testing.T) {
+	server := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}, nil)
+
+	dir := t.TempDir()
+	certFile := writeFile(t, dir, "server.crt", server.certPEM)
+	keyFile := writeFile(t, dir, "server.key", server.keyPEM)
+
+	c := caddy.NewTestController("dns", `temptxt {
+	tls `+certFile+` `+keyFile+`
+	listen 127.0.0.1:0
+}`)
+	tt, err := parseConfig(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tt.records["test.example.com."] = &Record{fqdn: "test.example.com.", store: tt.store, allowed: []*regexp.Regexp{regexp.MustCompile("^user1$")}}
+	tt.aliases["test.example.com."] = tt.records["test.example.com."]
+	if err := tt.OnStartup(); err != nil {
+		t.Fatalf("Error starting server: %v", err)
+	}
+	defer tt.OnFinalShutdown()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.cert)
+	client := http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	req, err := http.NewRequest("PUT", "https://"+tt.listener.Addr().String()+"/update", bytes.NewBufferString(`{"fqdn": "test.example.com", "content": "a"}`))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Forwarded-User", "user1")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	resp.Body.Close()
+	assertStatus(http.StatusNoContent, resp, t)
+}
@@ -0,0 +1,175 @@
+package temptxt
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultWaitTimeout = 60 * time.Second
+	// waitInterval is the time between queries to the nameservers.
+	waitInterval = 500 * time.Millisecond
+)
+
+// waitForPropagation waits until done returns true for the values of the record
+// and the values served by each of tt.nameservers.
+// An error is returned if that doesn't happen within tt.waitTimeout.
+func (tt *TempTxt) waitForPropagation(ctx context.Context, record *Record, done func([]string) bool) error {
+	ctx, cancel := context.WithTimeout(ctx, tt.waitTimeout)
+	defer cancel()
+
+	// "" is ourselves
+	pending := append([]string{""}, tt.nameservers...)
+	for {
+		remaining := pending[:0]
+		for _, ns := range pending {
+			if !tt.propagated(ctx, ns, record, done) {
+				remaining = append(remaining, ns)
+			}
+		}
+		if len(remaining) == 0 {
+			return nil
+		}
+		pending = remaining
+
+		select {
+		case <-ctx.Done():
+			names := make([]string, len(pending))
+			for i, ns := range pending {
+				names[i] = ns
+				if ns == "" {
+					names[i] = "temptxt"
+				}
+			}
+			return fmt.Errorf("timed out waiting for %s", strings.Join(names, ", "))
+		case <-time.After(waitInterval):
+		}
+	}
+}
+
+// propagated returns true if done returns true for the values served by the nameserver at addr.
+// If addr is "", the answer of ServeDNS is used.
+func (tt *TempTxt) propagated(ctx context.Context, addr string, record *Record, done func([]string) bool) bool {
+	var values []string
+	var err error
+	if addr == "" {
+		values, err = tt.localTXT(record)
+	} else {
+		values, err = queryTXT(ctx, addr, record.fqdn)
+	}
+	return err == nil && done(values)
+}
+
+// localTXT returns the TXT values ServeDNS answers with for record.
+// The answer is written through a ScrubWriter like CoreDNS does for a query over TCP.
+func (tt *TempTxt) localTXT(record *Record) ([]string, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(record.fqdn, dns.TypeTXT)
+	m, err := tt.txtAnswer(req, record)
+	if err != nil || m == nil {
+		return nil, err
+	}
+	w := &msgWriter{}
+	if err := request.NewScrubWriter(req, w).WriteMsg(m); err != nil {
+		return nil, err
+	}
+	if w.msg == nil {
+		return nil, fmt.Errorf("no answer for %q", record.fqdn)
+	}
+	return txtValues(w.msg, record.fqdn), nil
+}
+
+// queryTXT returns the TXT values for name served by the nameserver at addr.
+// The query is sent again over TCP if the answer is truncated.
+func queryTXT(ctx context.Context, addr string, name string) ([]string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeTXT)
+	m.RecursionDesired = false
+
+	c := new(dns.Client)
+	resp, _, err := c.ExchangeContext(ctx, m, addr)
+	if err == nil && resp.Truncated {
+		c.Net = "tcp"
+		resp, _, err = c.ExchangeContext(ctx, m, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s returned %s", addr, dns.RcodeToString[resp.Rcode])
+	}
+	return txtValues(resp, name), nil
+}
+
+// txtValues returns the values of the TXT records for name in the answer of m.
+func txtValues(m *dns.Msg, name string) []string {
+	var values []string
+	for _, rr := range m.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.EqualFold(txt.Hdr.Name, name) {
+			values = append(values, strings.Join(txt.Txt, ""))
+		}
+	}
+	return values
+}
+
+// msgWriter is a dns.ResponseWriter for a local TCP client that keeps the message written to it.
+type msgWriter struct {
+	msg *dns.Msg
+}
+
+func (w *msgWriter) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv6loopback, Port: 53}
+}
+
+func (w *msgWriter) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv6loopback}
+}
+
+func (w *msgWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *msgWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *msgWriter) Close() error        { return nil }
+func (w *msgWriter) TsigStatus() error   { return nil }
+func (w *msgWriter) TsigTimersOnly(bool) {}
+func (w *msgWriter) Hijack()             {}
+
+// hasValue returns a function for waitForPropagation that returns
+// true if v is one of the values.
+func hasValue(v string) func([]string) bool {
+	return func(values []string) bool {
+		for _, value := range values {
+			if value == v {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// notHasValue is the opposite of hasValue.
+func notHasValue(v string) func([]string) bool {
+	has := hasValue(v)
+	return func(values []string) bool { return !has(values) }
+}
+
+// noValues returns true if there are no values.
+func noValues(values []string) bool {
+	return len(values) == 0
+}
@@ -0,0 +1,213 @@
+package temptxt
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+)
+
+// testNameserver is a nameserver that answers TXT queries with values.
+type testNameserver struct {
+	addr   string
+	mtx    sync.Mutex
+	values []string
+}
+
+// newTestNameserver returns a nameserver listening on UDP and TCP.
+// Answers over UDP are truncated to 512 bytes.
+func newTestNameserver(t *testing.T) *testNameserver {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	ns := &testNameserver{addr: pc.LocalAddr().String()}
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		ns.mtx.Lock()
+		for _, v := range ns.values {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+				Txt: []string{v},
+			})
+		}
+		ns.mtx.Unlock()
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			m.Truncate(dns.MinMsgSize)
+		}
+		w.WriteMsg(m)
+	})
+	for _, s := range []*dns.Server{{PacketConn: pc, Handler: handler}, {Listener: l, Handler: handler}} {
+		s := s
+		started := make(chan struct{})
+		s.NotifyStartedFunc = func() { close(started) }
+		go s.ActivateAndServe()
+		<-started
+		t.Cleanup(func() { s.Shutdown() })
+	}
+	return ns
+}
+
+func (ns *testNameserver) set(values ...string) {
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	ns.values = values
+}
+
+func newWaitTempTxt(t *testing.T, nameservers ...string) *TempTxt {
+	t.Helper()
+	tt := newTestTempTxt(t, recordDef{FQDN: "test.example.com", Allowed: []string{"user1"}})
+	tt.nameservers = nameservers
+	tt.waitTimeout = 5 * time.Second
+	return tt
+}
+
+func TestQueryTXT(t *testing.T) {
+	ns := newTestNameserver(t)
+	ns.set("a", "b")
+
+	values, err := queryTXT(context.Background(), ns.addr, "test.example.com.")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(values, want) {
+		t.Errorf("Expected %v, got %v", want, values)
+	}
+}
+
+// Truncated answers should be queried again over TCP.
+func TestQueryTXTTruncated(t *testing.T) {
+	ns := newTestNameserver(t)
+	want := make([]string, 5)
+	for i := range want {
+		want[i] = strings.Repeat(string(rune('a'+i)), 200)
+	}
+	ns.set(want...)
+
+	values, err := queryTXT(context.Background(), ns.addr, "test.example.com.")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("Expected %d values, got %d", len(want), len(values))
+	}
+}
+
+// The local values should be the ones in the answer of ServeDNS.
+func TestLocalTXT(t *testing.T) {
+	tt := newWaitTempTxt(t)
+	r := tt.records["test.example.com."]
+
+	if values, err := tt.localTXT(r); err != nil || len(values) != 0 {
+		t.Fatalf("Expected no values, got %v, %v", values, err)
+	}
+
+	// More than fits in a UDP answer and in a single string
+	want := []string{strings.Repeat("a", 300), strings.Repeat("b", 300)}
+	for _, v := range want {
+		if err := r.add(Value{Txt: v}, 0); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	values, err := tt.localTXT(r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("Expected %v, got %v", want, values)
+	}
+}
+
+func TestUpdateWait(t *testing.T) {
+	ns1 := newTestNameserver(t)
+	ns2 := newTestNameserver(t)
+	tt := newWaitTempTxt(t, ns1.addr, ns2.addr)
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	// ns2 only gets the value later
+	ns1.set("a")
+	go func() {
+		time.Sleep(waitInterval)
+		ns2.set("a")
+	}()
+
+	start := time.Now()
+	resp := sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "test.example.com", "content": "a", "wait": true}`, "user1")
+	resp.Body.Close()
+	assertStatus(http.StatusNoContent, resp, t)
+	if time.Since(start) < waitInterval {
+		t.Errorf("Expected the request to wait for ns2")
+	}
+
+	// The query parameter can also be used
+	ns1.set()
+	ns2.set()
+	resp = sendRequest(t, "PUT", s.URL+"/update?wait=true", `{"fqdn": "test.example.com", "content": "a", "action": "remove"}`, "user1")
+	resp.Body.Close()
+	assertStatus(http.StatusNoContent, resp, t)
+}
+
+func TestUpdateWaitTimeout(t *testing.T) {
+	ns := newTestNameserver(t)
+	tt := newWaitTempTxt(t, ns.addr)
+	tt.waitTimeout = 100 * time.Millisecond
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	resp := sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "test.example.com", "content": "a", "wait": true}`, "user1")
+	resp.Body.Close()
+	assertStatus(http.StatusGatewayTimeout, resp, t)
+
+	// The update is still applied
+	if want := []string{"a"}; !reflect.DeepEqual(valuesOf(t, tt.records["test.example.com."]), want) {
+		t.Errorf("Expected content %v, got %v", want, valuesOf(t, tt.records["test.example.com."]))
+	}
+}
+
+// Without nameservers, only our own answers are checked.
+func TestUpdateWaitNoNameservers(t *testing.T) {
+	tt := newWaitTempTxt(t)
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	resp := sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "test.example.com", "content": "", "wait": true}`, "user1")
+	resp.Body.Close()
+	assertStatus(http.StatusNoContent, resp, t)
+}
+
+func TestWaitConfig(t *testing.T) {
+	tt, err := parseConfig(caddy.NewTestController("dns", `temptxt {
+	nameservers 192.0.2.1 192.0.2.2:5353 2001:db8::1
+	wait_timeout 2m
+}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if want := []string{"192.0.2.1:53", "192.0.2.2:5353", "[2001:db8::1]:53"}; !reflect.DeepEqual(tt.nameservers, want) {
+		t.Errorf("Expected %v, got %v", want, tt.nameservers)
+	}
+	if tt.waitTimeout != 2*time.Minute {
+		t.Errorf("Expected %v, got %v", 2*time.Minute, tt.waitTimeout)
+	}
+
+	tt = getConfig("temptxt", t)
+	if tt.waitTimeout != defaultWaitTimeout {
+		t.Errorf("Expected %v, got %v", defaultWaitTimeout, tt.waitTimeout)
+	}
+}
@@ -0,0 +1,127 @@
+package temptxt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// webhookSignatureHeader is the hex encoded HMAC-SHA256 of the body.
+	webhookSignatureHeader = "X-Temptxt-Signature"
+	// webhookQueueSize is the number of events waiting to be sent before new events are dropped.
+	webhookQueueSize = 1000
+	// webhookMaxAttempts is the number of times an event is sent before it is dropped.
+	webhookMaxAttempts = 5
+	// defaultWebhookRetryDelay is the delay before the first retry. It doubles after each attempt.
+	defaultWebhookRetryDelay = time.Second
+)
+
+// webhookEvent is POSTed to the webhook for every change.
+type webhookEvent struct {
+	Time time.Time `json:"time"`
+	// Action is ActionAdd, ActionRemove, ActionClear or actionExpire.
+	Action string `json:"action"`
+	// FQDN is the name given in the request.
+	FQDN string `json:"fqdn,omitempty"`
+	// Record is the FQDN the record is served at, after resolving any alias.
+	Record string `json:"record"`
+	User   string `json:"user,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+// webhook sends events to a URL from a bounded queue so that
+// a slow or unavailable receiver never blocks updates or queries.
+type webhook struct {
+	url        string
+	secret     []byte
+	client     *http.Client
+	queue      chan webhookEvent
+	retryDelay time.Duration
+}
+
+func newWebhook(url string, secret string) *webhook {
+	return &webhook{
+		url:        url,
+		secret:     []byte(secret),
+		client:     &http.Client{Timeout: 10 * time.Second},
+		queue:      make(chan webhookEvent, webhookQueueSize),
+		retryDelay: defaultWebhookRetryDelay,
+	}
+}
+
+// run sends the queued events in order until ctx is done.
+func (wh *webhook) run(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-wh.queue:
+				if err := wh.deliver(ctx, e); err != nil {
+					log.Errorf("Error sending %s event for %q to webhook: %v", e.Action, e.Record, err)
+				}
+			}
+		}
+	}()
+}
+
+// deliver sends e, retrying with an exponential backoff.
+func (wh *webhook) deliver(ctx context.Context, e webhookEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	delay := wh.retryDelay
+	for attempt := 1; ; attempt++ {
+		err = wh.send(ctx, body)
+		if err == nil || attempt == webhookMaxAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (wh *webhook) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookSignatureHeader, sign(wh.secret, body))
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// notify queues e if a webhook is configured.
+// The event is dropped if the queue is full.
+func (tt *TempTxt) notify(e webhookEvent) {
+	if tt.webhook == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	select {
+	case tt.webhook.queue <- e:
+	default:
+		log.Errorf("Webhook queue is full, dropping %s event for %q", e.Action, e.Record)
+	}
+}
@@ -0,0 +1,234 @@
+package temptxt
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+const testWebhookSecret = "secret"
+
+// newWebhookReceiver returns a server that sends the events it receives to the returned channel.
+// Requests with an invalid signature fail the test.
+func newWebhookReceiver(t *testing.T) (*httptest.Server, chan webhookEvent) {
+	t.Helper()
+	events := make(chan webhookEvent, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Error reading body: %v", err)
+			return
+		}
+		if sig := r.Header.Get(webhookSignatureHeader); sig != sign([]byte(testWebhookSecret), body) {
+			t.Errorf("Invalid signature %q", sig)
+		}
+		e := webhookEvent{}
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Errorf("Invalid event %q: %v", body, err)
+		}
+		events <- e
+	}))
+	t.Cleanup(s.Close)
+	return s, events
+}
+
+func newWebhookTempTxt(t *testing.T, url string) *TempTxt {
+	t.Helper()
+	tt := newTestTempTxt(t, testRecordDef)
+	tt.webhook = newWebhook(url, testWebhookSecret)
+	tt.webhook.retryDelay = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	tt.webhook.run(ctx)
+	return tt
+}
+
+// receiveEvent returns the next event from events without the time.
+func receiveEvent(t *testing.T, events chan webhookEvent) webhookEvent {
+	t.Helper()
+	select {
+	case e := <-events:
+		if e.Time.IsZero() {
+			t.Errorf("Expected the time to be set: %+v", e)
+		}
+		e.Time = time.Time{}
+		return e
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for an event")
+	}
+	return webhookEvent{}
+}
+
+func TestWebhookUpdate(t *testing.T) {
+	receiver, events := newWebhookReceiver(t)
+	tt := newWebhookTempTxt(t, receiver.URL)
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	for _, body := range []string{
+		`{"fqdn": "test1.example.com", "content": "a"}`,
+		`{"fqdn": "test1.example.com", "content": "a", "action": "remove"}`,
+		// Removing a value that isn't there doesn't change anything
+		`{"fqdn": "test1.example.com", "content": "a", "action": "remove"}`,
+		`{"fqdn": "test1.example.com"}`,
+	} {
+		resp := sendRequest(t, "PUT", s.URL+"/update", body, "user1")
+		resp.Body.Close()
+		assertStatus(http.StatusNoContent, resp, t)
+	}
+	// Rejected updates aren't sent
+	resp := sendRequest(t, "PUT", s.URL+"/update", `{"fqdn": "test1.example.com", "content": "b"}`, "user2")
+	resp.Body.Close()
+
+	assertEvents(t, events, []webhookEvent{
+		{Action: ActionAdd, FQDN: "test1.example.com.", Record: "_acme-challenge.test1.example.com.", User: "user1", Value: "a"},
+		{Action: ActionRemove, FQDN: "test1.example.com.", Record: "_acme-challenge.test1.example.com.", User: "user1", Value: "a"},
+		{Action: ActionClear, FQDN: "test1.example.com.", Record: "_acme-challenge.test1.example.com.", User: "user1"},
+	})
+}
+
+// assertEvents checks that the next events are want and that there are no others.
+func assertEvents(t *testing.T, events chan webhookEvent, want []webhookEvent) {
+	t.Helper()
+	for i, w := range want {
+		if e := receiveEvent(t, events); e != w {
+			t.Errorf("[%d] Expected %+v, got %+v", i, w, e)
+		}
+	}
+	select {
+	case e := <-events:
+		t.Errorf("Unexpected event %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhookLego(t *testing.T) {
+	receiver, events := newWebhookReceiver(t)
+	tt := newWebhookTempTxt(t, receiver.URL)
+	s := httptest.NewServer(tt.handler())
+	defer s.Close()
+
+	// The second cleanup doesn't change anything
+	for _, path := range []string{"/present", "/cleanup", "/cleanup"} {
+		resp := legoRequest(t, s.URL+path, "user1", `{"fqdn": "_acme-challenge.test1.example.com.", "value": "a"}`)
+		resp.Body.Close()
+		assertStatus(http.StatusOK, resp, t)
+	}
+	// Rejected requests aren't sent
+	resp := legoRequest(t, s.URL+"/present", "user2", `{"fqdn": "_acme-challenge.test1.example.com.", "value": "b"}`)
+	resp.Body.Close()
+
+	assertEvents(t, events, []webhookEvent{
+		{Action: ActionAdd, FQDN: "_acme-challenge.test1.example.com.", Record: "_acme-challenge.test1.example.com.", User: "user1", Value: "a"},
+		{Action: ActionRemove, FQDN: "_acme-challenge.test1.example.com.", Record: "_acme-challenge.test1.example.com.", User: "user1", Value: "a"},
+	})
+}
+
+func TestWebhookRFC2136(t *testing.T) {
+	receiver, events := newWebhookReceiver(t)
+	tt := newWebhookTempTxt(t, receiver.URL)
+	tt.tsigKeys = map[string]tsigKey{"key1.": {secret: testTsigSecret, user: "user1"}}
+
+	m := new(dns.Msg)
+	m.SetUpdate("example.com.")
+	m.Insert([]dns.RR{test.TXT(`_acme-challenge.test1.example.com. 60 IN TXT "a"`)})
+	m.Remove([]dns.RR{test.TXT(`_acme-challenge.test1.example.com. 60 IN TXT "a"`)})
+	// Removing a value that isn't there doesn't change anything
+	m.Remove([]dns.RR{test.TXT(`_acme-challenge.test1.example.com. 60 IN TXT "b"`)})
+	m.RemoveRRset([]dns.RR{test.TXT(`_acme-challenge.test1.example.com. 60 IN TXT "a"`)})
+	if code := sendUpdate(t, tt, signedUpdate(t, m, "key1.", testTsigSecret, false)); code != dns.RcodeSuccess {
+		t.Fatalf("Expected rcode %s, but got %s", dns.RcodeToString[dns.RcodeSuccess], dns.RcodeToString[code])
+	}
+	// Rejected updates aren't sent
+	m = new(dns.Msg)
+	m.SetUpdate("example.com.")
+	m.Insert([]dns.RR{test.TXT(`_acme-challenge.test1.example.com. 60 IN TXT "a"`)})
+	sendUpdate(t, tt, m)
+
+	assertEvents(t, events, []webhookEvent{
+		{Action: ActionAdd, FQDN: "_acme-challenge.test1.example.com.", Record: "_acme-challenge.test1.example.com.", User: "user1", Value: "a"},
+		{Action: ActionRemove, FQDN: "_acme-challenge.test1.example.com.", Record: "_acme-challenge.test1.example.com.", User: "user1", Value: "a"},
+		{Action: ActionClear, FQDN: "_acme-challenge.test1.example.com.", Record: "_acme-challenge.test1.example.com.", User: "user1"},
+	})
+}
+
+func TestWebhookClean(t *testing.T) {
+	receiver, events := newWebhookReceiver(t)
+	tt := newWebhookTempTxt(t, receiver.URL)
+	tt.cleanInterval = 10 * time.Millisecond
+	now := time.Now()
+	setStates(t, tt.store, map[string]RecordState{
+		"_acme-challenge.test1.example.com.": {
+			Values:  []Value{{Txt: "a", Created: now.Add(-5 * time.Minute)}, {Txt: "b", Created: now}, {Txt: "c", Created: now.Add(-5 * time.Minute)}},
+			Updated: now,
+		},
+	})
+	tt.setModified()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tt.Run(ctx)
+
+	for i, txt := range []string{"a", "c"} {
+		want := webhookEvent{Action: actionExpire, Record: "_acme-challenge.test1.example.com.", Value: txt}
+		if e := receiveEvent(t, events); e != want {
+			t.Errorf("[%d] Expected %+v, got %+v", i, want, e)
+		}
+	}
+}
+
+// Failed deliveries should be retried.
+func TestWebhookRetry(t *testing.T) {
+	receiver, events := newWebhookReceiver(t)
+	var attempts int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < webhookMaxAttempts {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		receiver.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	tt := newWebhookTempTxt(t, s.URL)
+	tt.notify(webhookEvent{Action: ActionAdd, Record: "_acme-challenge.test1.example.com.", Value: "a"})
+
+	want := webhookEvent{Action: ActionAdd, Record: "_acme-challenge.test1.example.com.", Value: "a"}
+	if e := receiveEvent(t, events); e != want {
+		t.Errorf("Expected %+v, got %+v", want, e)
+	}
+	if n := atomic.LoadInt32(&attempts); n != webhookMaxAttempts {
+		t.Errorf("Expected %d attempts, got %d", webhookMaxAttempts, n)
+	}
+}
+
+// Events should be dropped instead of blocking when the queue is full.
+func TestWebhookQueueFull(t *testing.T) {
+	tt := &TempTxt{webhook: newWebhook("http://192.0.2.1", testWebhookSecret)}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < webhookQueueSize+10; i++ {
+			tt.notify(webhookEvent{Action: ActionAdd, Record: "_acme-challenge.test1.example.com."})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("notify blocked on a full queue")
+	}
+	if n := len(tt.webhook.queue); n != webhookQueueSize {
+		t.Errorf("Expected %d queued events, got %d", webhookQueueSize, n)
+	}
+}
@@ -0,0 +1,93 @@
+package temptxt
+
+import (
+	"context"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// serveZone answers queries for names in the zone of the SOA.
+// Unlike names outside the zone, nothing is passed to the next plugin
+// unless the values can't be read from the store.
+func (tt *TempTxt) serveZone(ctx context.Context, state request.Request, name string) (int, error) {
+	zone := tt.soa.Hdr.Name
+
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative = true
+
+	record, ok := tt.servedRecord(name)
+	switch {
+	case ok && state.QType() == dns.TypeTXT:
+		answers, err := record.answers(state.QName(), tt.ttl)
+		if err != nil {
+			log.Errorf("Error getting values of %q: %v", record.fqdn, err)
+			queryCount.WithLabelValues(metrics.WithServer(ctx), record.fqdn, resultNext).Inc()
+			return plugin.NextOrFailure(tt.Name(), tt.Next, ctx, state.W, state.Req)
+		}
+		m.Answer = answers
+		if len(m.Answer) > 0 {
+			queryCount.WithLabelValues(metrics.WithServer(ctx), record.fqdn, resultAnswered).Inc()
+		} else {
+			queryCount.WithLabelValues(metrics.WithServer(ctx), record.fqdn, resultNoData).Inc()
+			m.Ns = []dns.RR{tt.soa}
+		}
+	case name == zone && state.QType() == dns.TypeSOA:
+		m.Answer = []dns.RR{tt.soa}
+	case name == zone && state.QType() == dns.TypeNS:
+		m.Answer = []dns.RR{tt.ns()}
+	case name == zone && state.QType() == dns.TypeDNSKEY && tt.signer != nil:
+		m.Answer = tt.dnskeys()
+	case ok || name == zone || tt.hasSubdomain(name):
+		// NODATA
+		m.Ns = []dns.RR{tt.soa}
+	default:
+		m.Rcode = dns.RcodeNameError
+		m.Ns = []dns.RR{tt.soa}
+	}
+
+	state.W.WriteMsg(tt.sign(ctx, state, m))
+
+	return dns.RcodeSuccess, nil
+}
+
+// ns returns the NS record for the zone using the SOA's MNAME.
+func (tt *TempTxt) ns() *dns.NS {
+	return &dns.NS{
+		Hdr: dns.RR_Header{Name: tt.soa.Hdr.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: tt.soa.Hdr.Ttl},
+		Ns:  tt.soa.Ns,
+	}
+}
+
+// hasSubdomain returns true if there is a record below name.
+// Names that only exist because of a record below them (empty non-terminals)
+// must return NODATA instead of NXDOMAIN.
+func (tt *TempTxt) hasSubdomain(name string) bool {
+	tt.mtx.RLock()
+	defer tt.mtx.RUnlock()
+	for r := range tt.records {
+		if strings.HasSuffix(r, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// newSOA returns the SOA for zone. The TTL and the minimum TTL are both ttl
+// so that negative answers are only cached for a short time.
+func newSOA(zone string, mname string, rname string, ttl uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      mname,
+		Mbox:    rname,
+		Serial:  1,
+		Refresh: 7200,
+		Retry:   1800,
+		Expire:  86400,
+		Minttl:  ttl,
+	}
+}
@@ -0,0 +1,167 @@
+package temptxt
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func newZoneTempTxt(t *testing.T) *TempTxt {
+	t.Helper()
+	tt := newTestTempTxt(t,
+		recordDef{FQDN: "_acme-challenge.www.acme.example.com", Allowed: []string{"user1"}},
+		recordDef{FQDN: "_acme-challenge.empty.acme.example.com", Allowed: []string{"user1"}},
+	)
+	tt.Next = testHandler()
+	tt.ttl = 30
+	tt.soa = newSOA("acme.example.com.", "ns1.example.com.", "hostmaster.example.com.", tt.ttl)
+	setStates(t, tt.store, map[string]RecordState{
+		"_acme-challenge.www.acme.example.com.": {Values: []Value{{Txt: "www"}}},
+	})
+	return tt
+}
+
+func TestServeZone(t *testing.T) {
+	tt := newZoneTempTxt(t)
+
+	const soa = `acme.example.com.	30	IN	SOA	ns1.example.com. hostmaster.example.com. 1 7200 1800 86400 30`
+
+	tests := []struct {
+		qname      string
+		qtype      uint16
+		wantRcode  int
+		wantAnswer []string
+		wantNs     []string
+	}{
+		{
+			qname:      "_acme-challenge.www.acme.example.com.",
+			qtype:      dns.TypeTXT,
+			wantAnswer: []string{`_acme-challenge.www.acme.example.com.	30	IN	TXT	"www"`},
+		},
+		// NODATA for an empty record
+		{
+			qname:  "_acme-challenge.empty.acme.example.com.",
+			qtype:  dns.TypeTXT,
+			wantNs: []string{soa},
+		},
+		// NODATA for other types
+		{
+			qname:  "_acme-challenge.www.acme.example.com.",
+			qtype:  dns.TypeA,
+			wantNs: []string{soa},
+		},
+		// NODATA for an empty non-terminal
+		{
+			qname:  "www.acme.example.com.",
+			qtype:  dns.TypeTXT,
+			wantNs: []string{soa},
+		},
+		{
+			qname:     "unknown.acme.example.com.",
+			qtype:     dns.TypeTXT,
+			wantRcode: dns.RcodeNameError,
+			wantNs:    []string{soa},
+		},
+		{
+			qname:      "acme.example.com.",
+			qtype:      dns.TypeSOA,
+			wantAnswer: []string{soa},
+		},
+		{
+			qname:      "acme.example.com.",
+			qtype:      dns.TypeNS,
+			wantAnswer: []string{`acme.example.com.	30	IN	NS	ns1.example.com.`},
+		},
+		{
+			qname:  "acme.example.com.",
+			qtype:  dns.TypeTXT,
+			wantNs: []string{soa},
+		},
+	}
+
+	for i, tc := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.qname, tc.qtype)
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := tt.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Errorf("[%d] Unexpected error %v", i, err)
+			continue
+		}
+
+		if rec.Msg.Rcode != tc.wantRcode {
+			t.Errorf("[%d] Expected rcode %s, but got %s", i, dns.RcodeToString[tc.wantRcode], dns.RcodeToString[rec.Msg.Rcode])
+		}
+		if !rec.Msg.Authoritative {
+			t.Errorf("[%d] Expected authoritative to be true", i)
+		}
+		assertRRs(t, i, "answer", tc.wantAnswer, rec.Msg.Answer)
+		assertRRs(t, i, "authority", tc.wantNs, rec.Msg.Ns)
+	}
+}
+
+// Queries outside the zone should fallthrough.
+func TestServeZoneOutside(t *testing.T) {
+	tt := newZoneTempTxt(t)
+
+	req := new(dns.Msg)
+	req.SetQuestion("other.example.com.", dns.TypeTXT)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	code, err := tt.ServeDNS(context.Background(), rec, req)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if code != dns.RcodeServerFailure {
+		t.Errorf("Expected rcode %s, but got %s", dns.RcodeToString[dns.RcodeServerFailure], dns.RcodeToString[code])
+	}
+}
+
+// The TTL should also be used without a SOA.
+func TestServeTTL(t *testing.T) {
+	tt := newTestTempTxt(t, recordDef{FQDN: "test.example.com", Allowed: []string{"user1"}})
+	tt.Next = testHandler()
+	tt.ttl = 60
+	setStates(t, tt.store, map[string]RecordState{"test.example.com.": {Values: []Value{{Txt: "a"}}}})
+
+	req := new(dns.Msg)
+	req.SetQuestion("test.example.com.", dns.TypeTXT)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := tt.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	assertRRs(t, 0, "answer", []string{`test.example.com.	60	IN	TXT	"a"`}, rec.Msg.Answer)
+}
+
+// The OPT record of the request should be echoed in answers for the zone.
+func TestServeZoneEdns0(t *testing.T) {
+	tt := newZoneTempTxt(t)
+
+	req := new(dns.Msg)
+	req.SetQuestion("acme.example.com.", dns.TypeSOA)
+	req.SetEdns0(1232, false)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	// CoreDNS wraps the writer of every query in a ScrubWriter
+	if _, err := tt.ServeDNS(context.Background(), request.NewScrubWriter(req, rec), req); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if opt := rec.Msg.IsEdns0(); opt == nil || opt.UDPSize() != 1232 {
+		t.Errorf("Expected an OPT record with size %d, got %v", 1232, opt)
+	}
+}
+
+func assertRRs(t *testing.T, i int, section string, want []string, have []dns.RR) {
+	t.Helper()
+	if len(want) != len(have) {
+		t.Errorf("[%d] Expected %d %s RR(s), got %d: %v", i, len(want), section, len(have), have)
+		return
+	}
+	for j, rr := range have {
+		if rr.String() != want[j] {
+			t.Errorf("[%d] Expected %s RR %q, got %q", i, section, want[j], rr)
+		}
+	}
+}